@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// batchable lists the sources that can be batched: their queries
+// for a domain already cover its subdomains
+var batchable = map[string]bool{
+	"wayback":     true,
+	"commoncrawl": true,
+}
+
+// secondLevel lists labels that commonly sit between a two-letter
+// country code and the registrable name, as in example.co.uk
+var secondLevel = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true,
+	"gov": true, "net": true, "org": true,
+}
+
+// parentDomain guesses the registrable domain that domain belongs to,
+// e.g. example.com for a.b.example.com or example.co.uk for
+// www.example.co.uk. It's only a heuristic, since there's no public
+// suffix list to hand.
+func parentDomain(domain string) string {
+	labels := strings.Split(strings.ToLower(strings.Trim(domain, ".")), ".")
+	n := 2
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 && secondLevel[labels[len(labels)-2]] {
+		n = 3
+	}
+	if len(labels) < n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// domainBatcher answers queries for several related domains with a
+// single query for the domain they share, which is fetched once per
+// source and then split up between them
+type domainBatcher struct {
+	// parents maps each batched domain to the domain it's fetched through
+	parents map[string]string
+
+	// entries holds the shared results for each source and parent
+	entries map[string]*batchEntry
+}
+
+// batchEntry is one source's results for a parent domain
+type batchEntry struct {
+	mu        sync.Mutex
+	results   []wurl
+	fetched   bool
+	remaining int
+
+	// served holds the domains that have had the results, so that
+	// asking again (as -retry-empty does) doesn't use up another's share
+	served map[string]bool
+}
+
+// newDomainBatcher groups domains by parentDomain, batching every
+// group with more than one member
+func newDomainBatcher(domains []string) *domainBatcher {
+	groups := make(map[string][]string)
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		p := parentDomain(d)
+		groups[p] = append(groups[p], d)
+	}
+
+	b := &domainBatcher{
+		parents: make(map[string]string),
+		entries: make(map[string]*batchEntry),
+	}
+	for p, members := range groups {
+		if len(members) < 2 {
+			continue
+		}
+		for _, d := range members {
+			b.parents[d] = p
+		}
+		for name := range batchable {
+			b.entries[name+" "+p] = &batchEntry{remaining: len(members), served: make(map[string]bool)}
+		}
+		verbosef("batching %d domains through %s", len(members), p)
+	}
+	return b
+}
+
+// wrap returns src with its queries for batched domains answered
+// from a shared query for their parent domain
+func (b *domainBatcher) wrap(src source) source {
+	if !batchable[src.name] {
+		return src
+	}
+
+	fetch := func(ctx context.Context, domain string, noSubs bool) ([]wurl, error) {
+		domain = strings.ToLower(domain)
+		parent, ok := b.parents[domain]
+		if !ok {
+			return src.fetch(ctx, domain, noSubs)
+		}
+
+		all, err := b.parentResults(ctx, src, parent, domain)
+		if err != nil {
+			return nil, err
+		}
+
+		out := make([]wurl, 0)
+		for _, w := range all {
+			u, err := url.Parse(w.url)
+			if err != nil {
+				continue
+			}
+			host := strings.ToLower(u.Hostname())
+			if host == domain || (!noSubs && strings.HasSuffix(host, "."+domain)) {
+				out = append(out, w)
+			}
+		}
+		return out, nil
+	}
+
+	return source{name: src.name, fetch: fetch}
+}
+
+// parentResults returns src's results for parent and its subdomains
+// to domain, fetching them the first time they're asked for and
+// forgetting them once every domain batched through parent has had
+// them. Failures aren't remembered, so the next domain tries again.
+func (b *domainBatcher) parentResults(ctx context.Context, src source, parent, domain string) ([]wurl, error) {
+	e := b.entries[src.name+" "+parent]
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.served[domain] {
+		e.served[domain] = true
+		e.remaining--
+	}
+
+	if !e.fetched {
+		all, err := src.fetch(ctx, parent, false)
+		if err != nil {
+			return nil, err
+		}
+		e.results = all
+		e.fetched = true
+	}
+
+	all := e.results
+	if e.remaining <= 0 {
+		e.results = nil
+		e.fetched = false
+	}
+	return all, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDomainBatcherRetries(t *testing.T) {
+	fetches := 0
+	src := source{"wayback", func(ctx context.Context, domain string, noSubs bool) ([]wurl, error) {
+		fetches++
+		return []wurl{
+			{url: "http://a.example.com/x"},
+			{url: "http://b.example.com/y"},
+		}, nil
+	}}
+
+	b := newDomainBatcher([]string{"a.example.com", "b.example.com"})
+	fetch := b.wrap(src).fetch
+
+	// a retried domain mustn't use up the other domain's share
+	for _, d := range []string{"a.example.com", "a.example.com", "b.example.com"} {
+		out, err := fetch(context.Background(), d, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 1 {
+			t.Errorf("%s: want 1 URL, have %d", d, len(out))
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("want 1 fetch of the parent domain, have %d", fetches)
+	}
+
+	// once every domain has had them, the results are forgotten
+	e := b.entries["wayback example.com"]
+	if e.fetched || e.results != nil {
+		t.Error("want the shared results to be dropped once every domain has had them")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// maxDomainFailures is how many consecutive failed requests a source can
+// make for a single domain before its remaining requests for that domain
+// are skipped. Zero disables the check.
+var maxDomainFailures int
+
+// breaker is a circuit breaker for one source querying one domain
+type breaker struct {
+	domain string
+	source string
+
+	mu       sync.Mutex
+	failures int
+}
+
+type breakerKey struct{}
+
+// withBreaker returns a copy of ctx carrying a fresh breaker for requests
+// that source makes for domain, so every domain starts with a clean slate
+func withBreaker(ctx context.Context, domain, source string) context.Context {
+	if maxDomainFailures <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, breakerKey{}, &breaker{domain: domain, source: source})
+}
+
+// breakerFrom returns the breaker carried by ctx, if there is one
+func breakerFrom(ctx context.Context) *breaker {
+	b, _ := ctx.Value(breakerKey{}).(*breaker)
+	return b
+}
+
+// check returns an error if the breaker has tripped
+func (b *breaker) check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= maxDomainFailures {
+		return fmt.Errorf("%s: skipping %s after %d consecutive failures", b.source, b.domain, b.failures)
+	}
+	return nil
+}
+
+// record counts a failed request, or resets the count after one
+// that succeeded, warning when the breaker trips
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures == maxDomainFailures {
+		warnf("%s: %d consecutive failures for %s, skipping its remaining requests", b.source, b.failures, b.domain)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The Common Crawl columnar ("zipnum") index is a set of gzipped CDX
+// segments plus a cluster.idx that records the first SURT key of every
+// gzip block in them. Both live in the public commoncrawl bucket, which
+// is readable anonymously over HTTPS, so a domain's captures can be
+// resolved with a handful of range requests instead of paging through
+// the index server.
+const ccBucketURL = "https://data.commoncrawl.org/cc-index/collections/" + ccIndex + "/indexes/"
+
+// ccProbeSize is how much of cluster.idx is fetched for each step of
+// the binary search; it only has to comfortably hold one full line
+const ccProbeSize = 4096
+
+// ccBlock is one line of cluster.idx
+type ccBlock struct {
+	key    string
+	file   string
+	offset int64
+	length int64
+}
+
+func getCommonCrawlS3URLs(ctx context.Context, domain string, noSubs bool) ([]wurl, error) {
+	out := make([]wurl, 0)
+
+	prefix := surtHost(domain)
+	if noSubs {
+		prefix += ")"
+	}
+
+	blocks, err := ccFindBlocks(ctx, prefix)
+	if err != nil {
+		return out, err
+	}
+
+	for _, b := range blocks {
+		urls, err := ccReadBlock(ctx, b, prefix, noSubs)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, urls...)
+	}
+
+	return out, nil
+}
+
+// surtHost converts a hostname into the reversed, comma-separated
+// form used as the start of SURT keys, e.g. example.com -> com,example
+func surtHost(domain string) string {
+	labels := strings.Split(strings.ToLower(strings.Trim(domain, ".")), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ",")
+}
+
+// ccKeyPast reports whether the SURT key k sorts after every key for
+// prefix. A bare host such as com,example matches keys that go on with
+// ")" (the host itself) or "," (a subdomain), which sort before other
+// hosts it's a prefix of, such as com,examples or com,example-cdn, so
+// the scan can stop as soon as it reaches one of those.
+func ccKeyPast(k, prefix string) bool {
+	if strings.HasSuffix(prefix, ")") {
+		return k > prefix && !strings.HasPrefix(k, prefix)
+	}
+	return k > prefix+"," && !strings.HasPrefix(k, prefix+",") && !strings.HasPrefix(k, prefix+")")
+}
+
+// ccFindBlocks returns the cluster.idx entries for the gzip blocks
+// that may contain keys starting with prefix
+func ccFindBlocks(ctx context.Context, prefix string) ([]ccBlock, error) {
+	idxURL := ccBucketURL + "cluster.idx"
+
+	size, err := ccContentLength(ctx, idxURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// binary search for an offset whose next full line sorts
+	// before prefix, so streaming from there can't miss the
+	// block that the first matching key falls into
+	var lo, hi int64 = 0, size
+	for hi-lo > ccProbeSize {
+		mid := lo + (hi-lo)/2
+		b, err := ccBlockAt(ctx, idxURL, mid)
+		if err != nil {
+			return nil, err
+		}
+		if b != nil && b.key < prefix {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	body, err := ccRange(ctx, idxURL, lo, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	r := bufio.NewReader(body)
+	if lo > 0 {
+		// discard the partial line we landed in
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+
+	var out []ccBlock
+	var prev *ccBlock
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			b, perr := parseCCBlock(line)
+			if perr != nil {
+				return nil, perr
+			}
+
+			// the previous block spans [prev.key, b.key)
+			if prev != nil && !ccKeyPast(prev.key, prefix) && b.key >= prefix {
+				out = append(out, *prev)
+			}
+			if ccKeyPast(b.key, prefix) {
+				return out, nil
+			}
+			prev = &b
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if prev != nil && !ccKeyPast(prev.key, prefix) {
+		out = append(out, *prev)
+	}
+	return out, nil
+}
+
+// ccBlockAt returns the first full cluster.idx line after offset,
+// or nil if there isn't one within the probe
+func ccBlockAt(ctx context.Context, idxURL string, offset int64) (*ccBlock, error) {
+	body, err := ccRange(ctx, idxURL, offset, offset+ccProbeSize-1)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(body, ccProbeSize))
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(raw), "\n")
+	if len(lines) < 3 {
+		return nil, nil
+	}
+
+	b, err := parseCCBlock(lines[1])
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// parseCCBlock parses a cluster.idx line, which looks like:
+// <surt key> <timestamp>\t<cdx file>\t<offset>\t<length>\t<sequence>
+func parseCCBlock(line string) (ccBlock, error) {
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+	if len(fields) < 4 {
+		return ccBlock{}, fmt.Errorf("malformed cluster.idx line [%s]", line)
+	}
+
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return ccBlock{}, fmt.Errorf("malformed cluster.idx offset [%s]", fields[2])
+	}
+	length, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return ccBlock{}, fmt.Errorf("malformed cluster.idx length [%s]", fields[3])
+	}
+
+	key := fields[0]
+	if i := strings.IndexByte(key, ' '); i != -1 {
+		key = key[:i]
+	}
+
+	return ccBlock{key: key, file: fields[1], offset: offset, length: length}, nil
+}
+
+// ccReadBlock fetches and decompresses a single gzip block from a
+// cdx segment, returning the captures whose key matches prefix
+func ccReadBlock(ctx context.Context, b ccBlock, prefix string, noSubs bool) ([]wurl, error) {
+	body, err := ccRange(ctx, ccBucketURL+b.file, b.offset, b.offset+b.length-1)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	out := make([]wurl, 0)
+
+	// segment lines look like: <surt key> <timestamp> <json>
+	sc := bufio.NewScanner(gz)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		key := fields[0]
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		// without noSubs the prefix is just the reversed host, so make
+		// sure the key is for that host or a subdomain of it rather than
+		// e.g. com,examples)
+		if !noSubs {
+			rest := key[len(prefix):]
+			if !strings.HasPrefix(rest, ")") && !strings.HasPrefix(rest, ",") {
+				continue
+			}
+		}
+
+		wrapper := struct {
+			URL    string `json:"url"`
+			Status string `json:"status"`
+			Length string `json:"length"`
+		}{}
+		if err := json.Unmarshal([]byte(fields[2]), &wrapper); err != nil {
+			continue
+		}
+
+		out = append(out, wurl{date: fields[1], url: wrapper.URL, status: wrapper.Status, length: wrapper.Length})
+	}
+
+	return out, sc.Err()
+}
+
+// ccContentLength returns the size of the object at u
+func ccContentLength(ctx context.Context, u string) (int64, error) {
+	req, err := newRequest(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	req.Method = http.MethodHead
+
+	res, err := doRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.ContentLength < 0 {
+		return 0, fmt.Errorf("unexpected response for %s: %s", u, res.Status)
+	}
+	return res.ContentLength, nil
+}
+
+// ccRange fetches bytes from..to (inclusive) of the object at u;
+// a negative to means through to the end of the object
+func ccRange(ctx context.Context, u string, from, to int64) (io.ReadCloser, error) {
+	req, err := newRequest(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if to < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", from))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to))
+	}
+
+	res, err := doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// a plain 200 means the range was ignored, which is only
+	// acceptable if we asked for the whole object anyway
+	whole := from == 0 && to < 0
+	if res.StatusCode != http.StatusPartialContent && !(whole && res.StatusCode == http.StatusOK) {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected response for %s: %s", u, res.Status)
+	}
+	return res.Body, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSurtHost(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"example.com", "com,example"},
+		{"www.Example.COM", "com,example,www"},
+		{"example.co.uk.", "uk,co,example"},
+		{"localhost", "localhost"},
+	}
+
+	for _, c := range cases {
+		if have := surtHost(c.in); have != c.want {
+			t.Errorf("surtHost(%q): want %q, have %q", c.in, c.want, have)
+		}
+	}
+}
+
+func TestParseCCBlock(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    ccBlock
+		wantErr bool
+	}{
+		{
+			"com,example)/ 20240101000000\tcdx-00001.gz\t1234\t567\t42\n",
+			ccBlock{key: "com,example)/", file: "cdx-00001.gz", offset: 1234, length: 567},
+			false,
+		},
+		{
+			"com,example)/a 20240101000000\tcdx-00002.gz\t0\t10\t1\r\n",
+			ccBlock{key: "com,example)/a", file: "cdx-00002.gz", offset: 0, length: 10},
+			false,
+		},
+		{"com,example)/ 20240101000000\tcdx-00001.gz\t1234\n", ccBlock{}, true},
+		{"com,example)/ 20240101000000\tcdx-00001.gz\tx\t567\t42\n", ccBlock{}, true},
+		{"com,example)/ 20240101000000\tcdx-00001.gz\t1234\ty\t42\n", ccBlock{}, true},
+		{"", ccBlock{}, true},
+	}
+
+	for _, c := range cases {
+		have, err := parseCCBlock(c.in)
+		if (err != nil) != c.wantErr {
+			t.Errorf("parseCCBlock(%q): want error %t, have %v", c.in, c.wantErr, err)
+			continue
+		}
+		if have != c.want {
+			t.Errorf("parseCCBlock(%q): want %+v, have %+v", c.in, c.want, have)
+		}
+	}
+}
+
+func TestCCKeyPast(t *testing.T) {
+	cases := []struct {
+		key    string
+		prefix string
+		want   bool
+	}{
+		{"com,examp)/", "com,example", false},
+		{"com,example)/", "com,example", false},
+		{"com,example,www)/", "com,example", false},
+		{"com,example-cdn)/", "com,example", true},
+		{"com,examples)/", "com,example", true},
+		{"com,google)/", "com,example", true},
+
+		{"com,example)/a", "com,example)", false},
+		{"com,example,www)/", "com,example)", true},
+	}
+
+	for _, c := range cases {
+		if have := ccKeyPast(c.key, c.prefix); have != c.want {
+			t.Errorf("ccKeyPast(%q, %q): want %t, have %t", c.key, c.prefix, c.want, have)
+		}
+	}
+}
+
+func TestCCFindBlocks(t *testing.T) {
+	// enough blocks either side for the binary search to take a few steps
+	var idx strings.Builder
+	line := func(key, file string) {
+		fmt.Fprintf(&idx, "%s 20240101000000\t%s\t0\t100\t1\n", key, file)
+	}
+	for i := 0; i < 500; i++ {
+		line(fmt.Sprintf("com,a%04d)/", i), fmt.Sprintf("before-%d", i))
+	}
+	line("com,example)/", "host")
+	line("com,example)/zzz", "host-2")
+	line("com,example,www)/", "sub")
+	line("com,example-cdn)/", "dash")
+	line("com,examples)/", "plural")
+	line("com,google)/", "other")
+	for i := 0; i < 500; i++ {
+		line(fmt.Sprintf("org,z%04d)/", i), fmt.Sprintf("after-%d", i))
+	}
+
+	mockSources(t, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "cluster.idx", time.Time{}, strings.NewReader(idx.String()))
+	})
+
+	cases := []struct {
+		prefix string
+		want   []string
+	}{
+		// the block before the first match can end with matching keys
+		{"com,example", []string{"before-499", "host", "host-2", "sub"}},
+		{"com,example)", []string{"before-499", "host", "host-2"}},
+		{"com,example,www", []string{"host-2", "sub"}},
+		{"com,examples", []string{"dash", "plural"}},
+		{"net,nothing", []string{"other"}},
+	}
+
+	for _, c := range cases {
+		blocks, err := ccFindBlocks(context.Background(), c.prefix)
+		if err != nil {
+			t.Fatalf("%s: %s", c.prefix, err)
+		}
+		var have []string
+		for _, b := range blocks {
+			have = append(have, b.file)
+		}
+		if !reflect.DeepEqual(have, c.want) {
+			t.Errorf("%s: want blocks %v, have %v", c.prefix, c.want, have)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// concurrencyFlag is the -concurrency value: either a fixed number
+// of concurrent requests, or auto to pick and adjust it at runtime
+type concurrencyFlag struct {
+	auto bool
+	n    int
+}
+
+func (c *concurrencyFlag) String() string {
+	if c.auto {
+		return "auto"
+	}
+	return strconv.Itoa(c.n)
+}
+
+func (c *concurrencyFlag) Set(v string) error {
+	if v == "auto" {
+		c.auto = true
+		return nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid concurrency [%s]; expected a positive number or auto", v)
+	}
+	c.auto = false
+	c.n = n
+	return nil
+}
+
+// The -concurrency auto heuristic starts at twice the number of CPUs,
+// capped at concurrencyMax, since almost all of the time is spent
+// waiting on the network rather than computing. From there it's
+// adjusted with AIMD, as in TCP congestion control: every successful
+// request raises the limit by concurrencyIncrease, and every 429
+// response multiplies it by concurrencyDecrease, backing off quickly
+// when a server starts rate limiting and creeping back up after.
+var (
+	concurrencyMax      = 32
+	concurrencyIncrease = 0.1
+	concurrencyDecrease = 0.5
+)
+
+// limiter caps the number of requests in flight at once; with
+// -concurrency auto, doRequest reports each outcome to it so that
+// the cap can adapt
+var limiter *aimdLimiter
+
+// aimdLimiter is a counting semaphore whose size can change while
+// it's in use
+type aimdLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    float64
+	max      float64
+	adaptive bool
+	inFlight int
+}
+
+// newLimiter returns a limiter for c, and the most requests it can
+// ever allow at once
+func newLimiter(c concurrencyFlag) (*aimdLimiter, int) {
+	l := &aimdLimiter{limit: float64(c.n), max: float64(c.n)}
+	if c.auto {
+		max := concurrencyMax
+		if max < 1 {
+			max = 1
+		}
+		start := runtime.NumCPU() * 2
+		if start > max {
+			start = max
+		}
+		l.limit = float64(start)
+		l.max = float64(max)
+		l.adaptive = true
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l, int(l.max)
+}
+
+// acquire blocks until another request is allowed
+func (l *aimdLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inFlight >= int(l.limit) {
+		l.cond.Wait()
+	}
+	l.inFlight++
+}
+
+// release marks a request allowed by acquire as finished
+func (l *aimdLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.cond.Broadcast()
+}
+
+// record adjusts the limit after a request has completed with err
+func (l *aimdLimiter) record(err error) {
+	if !l.adaptive {
+		return
+	}
+
+	var se *statusError
+	limited := errors.As(err, &se) && se.code == http.StatusTooManyRequests
+	if err != nil && !limited {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	old := int(l.limit)
+	if limited {
+		l.limit *= concurrencyDecrease
+		if l.limit < 1 {
+			l.limit = 1
+		}
+	} else {
+		l.limit += concurrencyIncrease
+		if l.limit > l.max {
+			l.limit = l.max
+		}
+	}
+
+	if now := int(l.limit); now != old {
+		verbosef("concurrency is now %d", now)
+		l.cond.Broadcast()
+	}
+}
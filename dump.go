@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// rawDumpDir is where -raw-dump writes each source's raw responses;
+// empty disables dumping
+var rawDumpDir string
+
+// dumpedPaths records the dump files written so far in this run, so
+// that each is truncated the first time it's written to and appended
+// to after that
+var (
+	dumpedMu    sync.Mutex
+	dumpedPaths = make(map[string]bool)
+)
+
+// dumpPath returns the file that res, made by the source and for the
+// domain in o, is dumped to: <dir>/<domain>.<source>.<ext>, with the
+// extension chosen from the response's content type
+func dumpPath(res *http.Response, o origin) string {
+	ext := "raw"
+	if mt, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err == nil {
+		switch {
+		case strings.Contains(mt, "json"):
+			ext = "json"
+		case strings.HasPrefix(mt, "text/"):
+			ext = "txt"
+		}
+	}
+
+	// domains come from the input, so keep them from
+	// escaping the directory or making odd file names
+	domain := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, o.domain)
+	domain = strings.TrimLeft(domain, ".")
+
+	return filepath.Join(rawDumpDir, domain+"."+o.source+"."+ext)
+}
+
+// dumpBody returns res's body with everything read from it also
+// written to its dump file. Failing to open the file is only a
+// warning, since dumping is a debugging aid.
+func dumpBody(res *http.Response, o origin) io.ReadCloser {
+	path := dumpPath(res, o)
+
+	dumpedMu.Lock()
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !dumpedPaths[path] {
+		flags |= os.O_TRUNC
+		dumpedPaths[path] = true
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	dumpedMu.Unlock()
+
+	if err != nil {
+		warnf("failed to open raw dump file: %s", err)
+		return res.Body
+	}
+	return &teeBody{r: io.TeeReader(res.Body, f), body: res.Body, f: f}
+}
+
+// teeBody is a response body whose reads are copied to a file,
+// which is closed along with the body
+type teeBody struct {
+	r    io.Reader
+	body io.ReadCloser
+	f    *os.File
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	return t.r.Read(p)
+}
+
+func (t *teeBody) Close() error {
+	t.f.Close()
+	return t.body.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// execSource is a command to run for each domain as an extra source,
+// with {{domain}} in any of its arguments replaced by the domain
+var execSource string
+
+// execTimeout limits how long each run of execSource can take
+var execTimeout time.Duration
+
+// getExecURLs runs execSource for domain and reads URLs from its stdout,
+// one per line, optionally preceded by a capture date and a tab. The
+// command is run directly rather than through a shell, so the domain
+// can't inject anything into it.
+func getExecURLs(ctx context.Context, domain string, noSubs bool) ([]wurl, error) {
+	out := make([]wurl, 0)
+
+	args := strings.Fields(execSource)
+	if len(args) == 0 {
+		return out, nil
+	}
+	for i, a := range args {
+		args[i] = strings.ReplaceAll(a, "{{domain}}", domain)
+	}
+
+	if execTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, execTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if !quiet {
+		cmd.Stderr = os.Stderr
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return out, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return out, err
+	}
+
+	// a bufio.Reader rather than a Scanner, which gives up on lines
+	// longer than 64KB and would leave the command blocked writing
+	// the rest of its output
+	r := bufio.NewReader(stdout)
+	var readErr error
+	for {
+		line, err := r.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			if date, u, ok := strings.Cut(line, "\t"); ok {
+				out = append(out, wurl{date: date, url: u})
+			} else {
+				out = append(out, wurl{url: line})
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			// drain stdout so the command can finish rather than
+			// blocking on a full pipe until it's killed
+			io.Copy(io.Discard, stdout)
+			break
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return out, fmt.Errorf("exec source %s: %w", args[0], err)
+	}
+	if readErr != nil {
+		return out, fmt.Errorf("exec source %s: failed to read output: %w", args[0], readErr)
+	}
+	return out, nil
+}
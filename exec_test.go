@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetExecURLsLongLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.txt")
+	long := "http://example.com/" + strings.Repeat("x", 100*1024)
+	body := long + "\n20200101000000\thttp://example.com/dated\nhttp://example.com/short"
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	execSource = "cat " + path
+	execTimeout = 10 * time.Second
+	defer func() { execSource, execTimeout = "", 0 }()
+
+	out, err := getExecURLs(context.Background(), "example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []wurl{
+		{url: long},
+		{date: "20200101000000", url: "http://example.com/dated"},
+		{url: "http://example.com/short"},
+	}
+	if len(out) != len(want) {
+		t.Fatalf("want %d results, have %d", len(want), len(out))
+	}
+	for i := range want {
+		if out[i] != want[i] {
+			t.Errorf("result %d: want %+v, have %+v", i, want[i], out[i])
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// capturedSince reports whether a capture date (in the 14 digit
+// YYYYMMDDhhmmss format) falls in minYear or later. Only the year
+// prefix is looked at, which avoids fully parsing every date on
+// very large result sets. Dates without a parseable year fail.
+func capturedSince(date string, minYear int) bool {
+	if len(date) < 4 {
+		return false
+	}
+
+	year, err := strconv.Atoi(date[:4])
+	if err != nil {
+		return false
+	}
+
+	return year >= minYear
+}
+
+// windowDeduper de-duplicates captures of the same URL unless they're
+// at least window apart, so that repeated crawls of a URL are thinned
+// out rather than collapsed into a single result
+type windowDeduper struct {
+	window time.Duration
+	last   map[string]time.Time
+}
+
+func newWindowDeduper(window time.Duration) *windowDeduper {
+	return &windowDeduper{
+		window: window,
+		last:   make(map[string]time.Time),
+	}
+}
+
+// allow reports whether a capture of the URL with the de-duplication
+// key and date should be emitted, remembering it if so. Captures without
+// a usable date are only allowed for URLs that haven't been emitted yet.
+func (d *windowDeduper) allow(key, date string) bool {
+	prev, seen := d.last[key]
+
+	t, err := time.Parse("20060102150405", date)
+	if err != nil {
+		if seen {
+			return false
+		}
+		d.last[key] = time.Time{}
+		return true
+	}
+
+	// sources don't return captures in date order, so the
+	// new capture could be either side of the previous one
+	if seen && !prev.IsZero() {
+		diff := t.Sub(prev)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff < d.window {
+			return false
+		}
+	}
+
+	d.last[key] = t
+	return true
+}
+
+// seenSet maps each de-duplication key to the source that first
+// reported it. With a size it only remembers that many of the most
+// recently seen keys, so memory use is bounded but a duplicate that
+// turns up long after the key was forgotten is treated as new.
+type seenSet struct {
+	size    int
+	sources map[string]*list.Element
+	order   *list.List
+}
+
+type seenEntry struct {
+	key    string
+	source string
+}
+
+// newSeenSet returns a seenSet holding up to size keys, or any
+// number of them if size is zero or less
+func newSeenSet(size int) *seenSet {
+	return &seenSet{
+		size:    size,
+		sources: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the source that key was first seen from,
+// counting as a use of it for the purposes of eviction
+func (s *seenSet) get(key string) (string, bool) {
+	e, ok := s.sources[key]
+	if !ok {
+		return "", false
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*seenEntry).source, true
+}
+
+// set records source as the one key was seen from, forgetting
+// the least recently used key if the set is full
+func (s *seenSet) set(key, source string) {
+	if e, ok := s.sources[key]; ok {
+		e.Value.(*seenEntry).source = source
+		s.order.MoveToFront(e)
+		return
+	}
+
+	s.sources[key] = s.order.PushFront(&seenEntry{key: key, source: source})
+	if s.size > 0 && s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.sources, oldest.Value.(*seenEntry).key)
+	}
+}
+
+// captureRange is the earliest and latest capture dates seen for
+// a URL, in the 14 digit YYYYMMDDhhmmss format
+type captureRange struct {
+	first string
+	last  string
+}
+
+// add widens the range to include date, ignoring dates that aren't
+// in the 14 digit format, which is what makes comparing them as
+// strings safe
+func (r *captureRange) add(date string) {
+	if len(date) != 14 || !isDigits(date) {
+		return
+	}
+	if r.first == "" || date < r.first {
+		r.first = date
+	}
+	if date > r.last {
+		r.last = date
+	}
+}
+
+// parseDays parses a duration that may also be given as a
+// whole number of days, e.g. 30d, as well as Go's usual 720h
+func parseDays(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration [%s]", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// pathDepth returns the number of non-empty segments in the path of
+// u, so that / has a depth of 0 and /a//b/ has a depth of 2
+func pathDepth(u *url.URL) int {
+	depth := 0
+	for _, seg := range strings.Split(u.Path, "/") {
+		if seg != "" {
+			depth++
+		}
+	}
+	return depth
+}
+
+// pathExtension returns the lowercased extension of the last segment
+// of u's path, without the dot, or "" if it doesn't have one
+func pathExtension(u *url.URL) string {
+	ext := path.Ext(u.Path)
+	return strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+// extensionSet parses a comma-separated list of extensions, each with
+// or without a leading dot
+func extensionSet(list string) map[string]bool {
+	out := make(map[string]bool)
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimLeft(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			out[ext] = true
+		}
+	}
+	return out
+}
+
+// keepExtension reports whether rawURL passes the -include-extensions
+// and -exclude-extensions filters: its extension must be in include,
+// unless include is empty, and mustn't be in exclude. A URL that can't
+// be parsed is treated as having no extension.
+func keepExtension(rawURL string, include, exclude map[string]bool) bool {
+	ext := ""
+	if u, err := url.Parse(rawURL); err == nil {
+		ext = pathExtension(u)
+	}
+	if len(include) > 0 && !include[ext] {
+		return false
+	}
+	return !exclude[ext]
+}
+
+// sourcePriority ranks sources by name; a lower rank is a higher priority
+type sourcePriority map[string]int
+
+// parseSourcePriority parses a -source-priority list, highest priority first
+func parseSourcePriority(list string) (sourcePriority, error) {
+	known := map[string]bool{"wayback": true, "commoncrawl": true, "virustotal": true, "exec": true}
+
+	out := make(sourcePriority)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("invalid -source-priority source [%s]. Please choose from: wayback, commoncrawl, virustotal, exec", name)
+		}
+		if _, ok := out[name]; !ok {
+			out[name] = len(out)
+		}
+	}
+	return out, nil
+}
+
+// outranks reports whether source a has a higher priority than source b.
+// Sources that aren't listed rank below every source that is.
+func (p sourcePriority) outranks(a, b string) bool {
+	ra, ok := p[a]
+	if !ok {
+		return false
+	}
+	rb, ok := p[b]
+	if !ok {
+		return true
+	}
+	return ra < rb
+}
+
+// orderSources sorts srcs so that the sources named in the comma-separated
+// list come first, in that order, followed by the rest in their original
+// order. Every listed source must be one of srcs.
+func orderSources(srcs []source, list string) ([]source, error) {
+	enabled := make(map[string]bool)
+	for _, src := range srcs {
+		enabled[src.name] = true
+	}
+
+	rank := make(map[string]int)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !enabled[name] {
+			return nil, fmt.Errorf("invalid -sources-order source [%s]; it must be one of the enabled sources", name)
+		}
+		if _, ok := rank[name]; !ok {
+			rank[name] = len(rank)
+		}
+	}
+
+	out := append([]source(nil), srcs...)
+	sort.SliceStable(out, func(i, j int) bool {
+		ri, ok := rank[out[i].name]
+		if !ok {
+			ri = len(rank)
+		}
+		rj, ok := rank[out[j].name]
+		if !ok {
+			rj = len(rank)
+		}
+		return ri < rj
+	})
+	return out, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func TestPathDepth(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int
+	}{
+		{"http://example.com", 0},
+		{"http://example.com/", 0},
+		{"http://example.com/a", 1},
+		{"http://example.com/a/", 1},
+		{"http://example.com/a/b", 2},
+		{"http://example.com/a/b/", 2},
+		{"http://example.com//a//b", 2},
+		{"http://example.com/a/b?c=/d/e", 2},
+	}
+
+	for _, c := range cases {
+		u, err := url.Parse(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := pathDepth(u); have != c.want {
+			t.Errorf("pathDepth(%q): want %d, have %d", c.in, c.want, have)
+		}
+	}
+}
+
+func TestKeepExtension(t *testing.T) {
+	cases := []struct {
+		in      string
+		include string
+		exclude string
+		want    bool
+	}{
+		{"http://example.com/a.php", "", "", true},
+		{"http://example.com/a.php", "php,.aspx", "", true},
+		{"http://example.com/a.PHP", "php", "", true},
+		{"http://example.com/a.php?x=b.js", "php", "", true},
+		{"http://example.com/a.js?x=b.php", "php", "", false},
+		{"http://example.com/dir/", "php", "", false},
+		{"http://example.com/a.png", "", "png,jpg", false},
+		{"http://example.com/a.html", "", "png,jpg", true},
+
+		// with both, a URL has to be included and not excluded
+		{"http://example.com/a.php", "php,png", "png", true},
+		{"http://example.com/a.png", "php,png", "png", false},
+		{"http://example.com/a.js", "php,png", "png", false},
+	}
+
+	for _, c := range cases {
+		have := keepExtension(c.in, extensionSet(c.include), extensionSet(c.exclude))
+		if have != c.want {
+			t.Errorf("keepExtension(%q, %q, %q): want %t, have %t", c.in, c.include, c.exclude, c.want, have)
+		}
+	}
+}
+
+func benchmarkSeenSet(b *testing.B, size int) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("http://example.com/page/%d", i)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s := newSeenSet(size)
+		for _, k := range keys {
+			if _, ok := s.get(k); !ok {
+				s.set(k, "wayback")
+			}
+		}
+	}
+}
+
+func BenchmarkSeenSet(b *testing.B) {
+	benchmarkSeenSet(b, 0)
+}
+
+func BenchmarkSeenSetLRU(b *testing.B) {
+	benchmarkSeenSet(b, 1000)
+}
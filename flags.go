@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cdxCollapseRe matches the CDX server's collapse syntax: a field
+// name, optionally followed by how many leading characters to compare
+var cdxCollapseRe = regexp.MustCompile(`^(urlkey|timestamp|original|mimetype|statuscode|digest|length)(:[0-9]+)?$`)
+
+// cdxFilterFlag collects repeated -cdx-filter values
+type cdxFilterFlag []string
+
+// cdxFilterRe matches the CDX server's filter syntax: an optional !
+// to negate, an optional ~ for a substring match, then field:regex
+var cdxFilterRe = regexp.MustCompile(`^!?~?(urlkey|timestamp|original|mimetype|statuscode|digest|length):.+$`)
+
+func (f *cdxFilterFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *cdxFilterFlag) Set(v string) error {
+	if !cdxFilterRe.MatchString(v) {
+		return fmt.Errorf("invalid CDX filter [%s]; expected [!]field:regex, e.g. statuscode:200 or !mimetype:warc/revisit", v)
+	}
+	*f = append(*f, v)
+	return nil
+}
+
+// headerFlag collects repeated -header 'Name: Value' values
+type headerFlag http.Header
+
+// headerNameRe matches a valid HTTP header field name
+var headerNameRe = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+func (h headerFlag) String() string {
+	var out []string
+	for name, values := range h {
+		for _, v := range values {
+			out = append(out, name+": "+v)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+func (h headerFlag) Set(v string) error {
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid header [%s]; expected 'Name: Value'", v)
+	}
+
+	name := strings.TrimSpace(parts[0])
+	if !headerNameRe.MatchString(name) {
+		return fmt.Errorf("invalid header name [%s]", name)
+	}
+
+	http.Header(h).Add(name, strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// cdxURLFlag collects repeated -cdx-url values
+type cdxURLFlag []string
+
+func (f *cdxURLFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *cdxURLFlag) Set(v string) error {
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+		return fmt.Errorf("invalid CDX URL [%s]; expected e.g. https://web.archive.org/cdx/search/cdx", v)
+	}
+	*f = append(*f, v)
+	return nil
+}
+
+// retriesFlag sets the retry budget from a -retries value, which is
+// either a number, or a comma-separated list of source=number pairs,
+// optionally alongside a number for the sources that aren't listed
+type retriesFlag struct{}
+
+func (retriesFlag) String() string {
+	out := []string{strconv.Itoa(retries)}
+	names := make([]string, 0, len(sourceRetries))
+	for name := range sourceRetries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out = append(out, fmt.Sprintf("%s=%d", name, sourceRetries[name]))
+	}
+	return strings.Join(out, ",")
+}
+
+func (retriesFlag) Set(v string) error {
+	known := map[string]bool{"wayback": true, "commoncrawl": true, "virustotal": true, "exec": true}
+
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, count := "", item
+		if i := strings.IndexByte(item, '='); i != -1 {
+			name, count = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+			if !known[name] {
+				return fmt.Errorf("invalid source [%s]. Please choose from: wayback, commoncrawl, virustotal, exec", name)
+			}
+		}
+
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid retry count [%s]; expected e.g. 2 or wayback=5,virustotal=1", item)
+		}
+
+		if name == "" {
+			retries = n
+		} else {
+			sourceRetries[name] = n
+		}
+	}
+	return nil
+}
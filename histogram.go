@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sizeBuckets are the upper bounds, in bytes, of each -size-histogram
+// bucket but the last, which holds everything bigger
+var sizeBuckets = []struct {
+	label string
+	max   int64
+}{
+	{"<1KB", 1 << 10},
+	{"1-10KB", 10 << 10},
+	{"10-100KB", 100 << 10},
+	{">100KB", -1},
+}
+
+// sizeHistogramWidth is the length of the longest bar
+const sizeHistogramWidth = 40
+
+// sizeHistogram counts results by the size of their archived response
+type sizeHistogram struct {
+	counts  []int
+	unknown int
+}
+
+func newSizeHistogram() *sizeHistogram {
+	return &sizeHistogram{counts: make([]int, len(sizeBuckets))}
+}
+
+// add counts a result with the given length field, which is empty
+// for sources that don't record one
+func (h *sizeHistogram) add(length string) {
+	n, err := strconv.ParseInt(length, 10, 64)
+	if err != nil || n < 0 {
+		h.unknown++
+		return
+	}
+
+	for i, b := range sizeBuckets {
+		if b.max < 0 || n < b.max {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+// write prints the histogram for domain to w
+func (h *sizeHistogram) write(w io.Writer, domain string) {
+	most := h.unknown
+	for _, c := range h.counts {
+		if c > most {
+			most = c
+		}
+	}
+
+	bar := func(c int) string {
+		if most == 0 {
+			return ""
+		}
+		return strings.Repeat("#", c*sizeHistogramWidth/most)
+	}
+
+	fmt.Fprintf(w, "%s: response sizes\n", domain)
+	for i, b := range sizeBuckets {
+		fmt.Fprintf(w, "  %-9s %7d %s\n", b.label, h.counts[i], bar(h.counts[i]))
+	}
+	if h.unknown > 0 {
+		fmt.Fprintf(w, "  %-9s %7d %s\n", "unknown", h.unknown, bar(h.unknown))
+	}
+}
+
+// writeHostStats prints the number of URLs found for each host of
+// domain to w, most first
+func writeHostStats(w io.Writer, domain string, counts map[string]int) {
+	hosts := make([]string, 0, len(counts))
+	for h := range counts {
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if counts[hosts[i]] != counts[hosts[j]] {
+			return counts[hosts[i]] > counts[hosts[j]]
+		}
+		return hosts[i] < hosts[j]
+	})
+
+	fmt.Fprintf(w, "%s: URLs per host\n", domain)
+	for _, h := range hosts {
+		if h == "" {
+			continue
+		}
+		fmt.Fprintf(w, "%7d %s\n", counts[h], h)
+	}
+	if n := counts[""]; n > 0 {
+		fmt.Fprintf(w, "%7d (no host)\n", n)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// readDomains reads the list of input domains from r in the given format:
+//
+//	lines: one domain per line
+//	csv:   the given column of each record, either a zero-based index
+//	       or the name of a column in the header row
+//	json:  an array of strings, or of objects with the given field
+func readDomains(r io.Reader, format, column, field string) ([]string, error) {
+	switch format {
+	case "lines":
+		return readDomainLines(r)
+	case "csv":
+		return readDomainCSV(r, column)
+	case "json":
+		return readDomainJSON(r, field)
+	default:
+		return nil, fmt.Errorf("invalid -input-format [%s]. Please choose from: lines, csv, json", format)
+	}
+}
+
+func readDomainLines(r io.Reader) ([]string, error) {
+	var out []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		out = append(out, sc.Text())
+	}
+	return out, sc.Err()
+}
+
+func readDomainCSV(r io.Reader, column string) ([]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	// a numeric column is an index; anything else names
+	// a column, which means the first record is a header
+	idx, err := strconv.Atoi(column)
+	byName := err != nil
+
+	var out []string
+	for first := true; ; first = false {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return out, err
+		}
+
+		if byName && first {
+			idx = -1
+			for i, name := range rec {
+				if strings.EqualFold(strings.TrimSpace(name), column) {
+					idx = i
+					break
+				}
+			}
+			if idx == -1 {
+				return nil, fmt.Errorf("no column named [%s] in the CSV header", column)
+			}
+			continue
+		}
+
+		if idx < 0 || idx >= len(rec) {
+			continue
+		}
+		out = append(out, strings.TrimSpace(rec[idx]))
+	}
+	return out, nil
+}
+
+func readDomainJSON(r io.Reader, field string) ([]string, error) {
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("expected a JSON array: %w", err)
+	}
+
+	var out []string
+	for _, item := range raw {
+		var s string
+		if err := json.Unmarshal(item, &s); err == nil {
+			out = append(out, s)
+			continue
+		}
+
+		var obj map[string]interface{}
+		if err := json.Unmarshal(item, &obj); err != nil {
+			return nil, fmt.Errorf("expected strings or objects in the JSON array, got %s", item)
+		}
+
+		if s, ok := obj[field].(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// splitWildcard strips a leading "*." from an input domain, reporting
+// whether it was there: *.example.com means subdomains of example.com
+// but not example.com itself. Wildcards anywhere else are an error.
+func splitWildcard(input string) (string, bool, error) {
+	domain := strings.TrimPrefix(input, "*.")
+	if domain == "" || strings.Contains(domain, "*") {
+		return "", false, fmt.Errorf("invalid domain [%s]; wildcards are only supported as a leading *.", input)
+	}
+	return domain, domain != input, nil
+}
+
+// hostLabelRe matches one label of a hostname: letters, digits,
+// hyphens and underscores, not starting or ending with a hyphen
+var hostLabelRe = regexp.MustCompile(`^[\p{L}\p{N}_]([\p{L}\p{N}_-]{0,61}[\p{L}\p{N}_])?$`)
+
+// checkInput returns an error saying what's wrong with input if it
+// doesn't look like a domain, or with inputType ip, an IP address
+func checkInput(input, inputType string) error {
+	if inputType == "ip" {
+		if net.ParseIP(input) == nil {
+			return fmt.Errorf("not an IP address")
+		}
+		return nil
+	}
+
+	domain, _, err := splitWildcard(input)
+	if err != nil {
+		return fmt.Errorf("has a wildcard other than a leading \"*.\"")
+	}
+
+	switch {
+	case strings.Contains(domain, "://"):
+		return fmt.Errorf("looks like a URL; pass just its hostname")
+	case strings.Contains(domain, "/"):
+		return fmt.Errorf("has a path; pass just the hostname")
+	case net.ParseIP(domain) != nil:
+		return nil
+	case strings.Contains(domain, ":"):
+		return fmt.Errorf("has a port; pass just the hostname")
+	}
+
+	domain = strings.TrimSuffix(domain, ".")
+	if len(domain) > 253 {
+		return fmt.Errorf("too long for a hostname")
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if !hostLabelRe.MatchString(label) {
+			return fmt.Errorf("not a valid hostname")
+		}
+	}
+	return nil
+}
+
+// validateInputs trims the input domains and drops blank lines and
+// # comments, along with any entries that checkInput rejects, which
+// are listed with -verbose. With strict set, a rejected entry is an
+// error instead.
+func validateInputs(inputs []string, inputType string, strict bool) ([]string, error) {
+	out := make([]string, 0, len(inputs))
+	skipped := 0
+	for _, input := range inputs {
+		input = strings.TrimSpace(input)
+		if input == "" || strings.HasPrefix(input, "#") {
+			continue
+		}
+
+		if err := checkInput(input, inputType); err != nil {
+			if strict {
+				return nil, fmt.Errorf("invalid input [%s]: %s", input, err)
+			}
+			verbosef("skipping invalid input [%s]: %s", input, err)
+			skipped++
+			continue
+		}
+		out = append(out, input)
+	}
+
+	if skipped > 0 {
+		warnf("skipped %d invalid inputs; use -verbose to list them, or -strict-input to stop on them", skipped)
+	}
+	return out, nil
+}
+
+// extractDomains applies re to each of lines, keeping its first capture
+// group, or the whole match if it has no groups. Lines that don't
+// match are skipped.
+func extractDomains(lines []string, re *regexp.Regexp) []string {
+	var out []string
+	for _, line := range lines {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			verbosef("skipping input line that doesn't match -input-regex: %s", line)
+			continue
+		}
+
+		if len(m) > 1 {
+			out = append(out, m[1])
+		} else {
+			out = append(out, m[0])
+		}
+	}
+	return out
+}
+
+// readSeedURLs reads the -seed-urls file at path: one URL per line,
+// ignoring surrounding whitespace, blank lines and lines starting with #
+func readSeedURLs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return out, sc.Err()
+}
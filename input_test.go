@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitWildcard(t *testing.T) {
+	cases := []struct {
+		in       string
+		domain   string
+		subsOnly bool
+		wantErr  bool
+	}{
+		{"*.example.com", "example.com", true, false},
+		{"example.com", "example.com", false, false},
+		{"sub.example.com", "sub.example.com", false, false},
+		{"**.x", "", false, true},
+		{"*.", "", false, true},
+		{"*", "", false, true},
+		{"a.*.example.com", "", false, true},
+		{"*.*.example.com", "", false, true},
+	}
+
+	for _, c := range cases {
+		domain, subsOnly, err := splitWildcard(c.in)
+		if (err != nil) != c.wantErr {
+			t.Errorf("splitWildcard(%q): want error %t, have %v", c.in, c.wantErr, err)
+			continue
+		}
+		if domain != c.domain || subsOnly != c.subsOnly {
+			t.Errorf("splitWildcard(%q): want %q, %t, have %q, %t", c.in, c.domain, c.subsOnly, domain, subsOnly)
+		}
+	}
+}
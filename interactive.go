@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// interactivePageSize is how many results are listed at a time
+const interactivePageSize = 20
+
+const interactiveHelp = `commands:
+  <text>        filter results to those containing text (case-insensitive)
+  /             clear the filter
+  n, p          next and previous page
+  m <n>...      mark results by number; u <n>... unmarks them
+  m *           mark every result matching the filter
+  e <file>      export marked results (or all matching, if none are marked) to file
+  c             copy marked results to the clipboard (via the terminal)
+  ?             show this help
+  q             quit`
+
+// browser holds the state of an -interactive session
+type browser struct {
+	urls    []string
+	filter  string
+	matches []int
+	page    int
+	marked  map[int]bool
+	out     io.Writer
+}
+
+// runInteractive lets the user browse, filter, mark and export urls,
+// reading commands a line at a time from in
+func runInteractive(urls []string, in io.Reader, out io.Writer) error {
+	b := &browser{urls: urls, marked: make(map[int]bool), out: out}
+	b.applyFilter("")
+
+	fmt.Fprintf(out, "%d results; ? for help\n", len(urls))
+	b.show()
+
+	sc := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "> ")
+		if !sc.Scan() {
+			fmt.Fprintln(out)
+			return sc.Err()
+		}
+
+		line := strings.TrimSpace(sc.Text())
+		cmd, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+
+		switch {
+		case line == "":
+			b.show()
+		case line == "q":
+			return nil
+		case line == "?":
+			fmt.Fprintln(out, interactiveHelp)
+		case line == "/":
+			b.applyFilter("")
+			b.show()
+		case line == "n":
+			if (b.page+1)*interactivePageSize < len(b.matches) {
+				b.page++
+			}
+			b.show()
+		case line == "p":
+			if b.page > 0 {
+				b.page--
+			}
+			b.show()
+		case cmd == "m" && arg != "":
+			b.setMarked(arg, true)
+		case cmd == "u" && arg != "":
+			b.setMarked(arg, false)
+		case cmd == "e" && arg != "":
+			if err := b.export(arg); err != nil {
+				fmt.Fprintf(out, "failed to export: %s\n", err)
+			}
+		case line == "c":
+			b.copy()
+		default:
+			b.applyFilter(line)
+			b.show()
+		}
+	}
+}
+
+// applyFilter sets the filter and works out which results match it
+func (b *browser) applyFilter(filter string) {
+	b.filter = strings.ToLower(filter)
+	b.page = 0
+	b.matches = b.matches[:0]
+	for i, u := range b.urls {
+		if strings.Contains(strings.ToLower(u), b.filter) {
+			b.matches = append(b.matches, i)
+		}
+	}
+}
+
+// show lists the current page of matching results
+func (b *browser) show() {
+	start := b.page * interactivePageSize
+	end := start + interactivePageSize
+	if end > len(b.matches) {
+		end = len(b.matches)
+	}
+
+	for _, i := range b.matches[start:end] {
+		mark := " "
+		if b.marked[i] {
+			mark = "*"
+		}
+		fmt.Fprintf(b.out, "%s %4d  %s\n", mark, i+1, b.urls[i])
+	}
+
+	fmt.Fprintf(b.out, "-- %d-%d of %d matching", start+1, end, len(b.matches))
+	if b.filter != "" {
+		fmt.Fprintf(b.out, " [%s]", b.filter)
+	}
+	fmt.Fprintf(b.out, ", %d marked --\n", len(b.marked))
+}
+
+// setMarked marks or unmarks the results numbered in arg,
+// or every matching result if arg is *
+func (b *browser) setMarked(arg string, mark bool) {
+	var idxs []int
+	if arg == "*" {
+		idxs = b.matches
+	} else {
+		for _, f := range strings.Fields(arg) {
+			n, err := strconv.Atoi(f)
+			if err != nil || n < 1 || n > len(b.urls) {
+				fmt.Fprintf(b.out, "no result numbered [%s]\n", f)
+				continue
+			}
+			idxs = append(idxs, n-1)
+		}
+	}
+
+	for _, i := range idxs {
+		if mark {
+			b.marked[i] = true
+		} else {
+			delete(b.marked, i)
+		}
+	}
+	fmt.Fprintf(b.out, "%d marked\n", len(b.marked))
+}
+
+// selected returns the marked results, or every
+// matching result if nothing has been marked
+func (b *browser) selected() []string {
+	var idxs []int
+	if len(b.marked) == 0 {
+		idxs = b.matches
+	} else {
+		for i := range b.marked {
+			idxs = append(idxs, i)
+		}
+		sort.Ints(idxs)
+	}
+
+	out := make([]string, 0, len(idxs))
+	for _, i := range idxs {
+		out = append(out, b.urls[i])
+	}
+	return out
+}
+
+func (b *browser) export(path string) error {
+	sel := b.selected()
+	if err := os.WriteFile(path, []byte(strings.Join(sel, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(b.out, "exported %d results to %s\n", len(sel), path)
+	return nil
+}
+
+// copy puts the selected results on the clipboard using the OSC 52
+// terminal escape sequence, which most modern terminals support
+func (b *browser) copy() {
+	sel := b.selected()
+	enc := base64.StdEncoding.EncodeToString([]byte(strings.Join(sel, "\n")))
+	fmt.Fprintf(b.out, "\033]52;c;%s\a", enc)
+	fmt.Fprintf(b.out, "copied %d results\n", len(sel))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spacedTransport is a RoundTripper that leaves at least interval
+// between the starts of consecutive requests to the same host, for
+// -min-interval. Requests that arrive together are given successive
+// slots rather than all waiting for the same one.
+type spacedTransport struct {
+	next     http.RoundTripper
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newSpacedTransport(next http.RoundTripper, interval time.Duration) *spacedTransport {
+	return &spacedTransport{next: next, interval: interval, last: make(map[string]time.Time)}
+}
+
+// reserve returns the time at which the next request to host may start,
+// and records it as the start of the latest one
+func (t *spacedTransport) reserve(host string) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	at := time.Now()
+	if last, ok := t.last[host]; ok && last.Add(t.interval).After(at) {
+		at = last.Add(t.interval)
+	}
+	t.last[host] = at
+	return at
+}
+
+func (t *spacedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	at := t.reserve(strings.ToLower(req.URL.Hostname()))
+	if wait := time.Until(at); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// apiKeyFlag collects repeated -api-key source=value values
+type apiKeyFlag map[string]string
+
+func (f apiKeyFlag) String() string {
+	var out []string
+	for source := range f {
+		out = append(out, source+"=...")
+	}
+	return strings.Join(out, ",")
+}
+
+func (f apiKeyFlag) Set(v string) error {
+	source, key, ok := strings.Cut(v, "=")
+	source = strings.ToLower(strings.TrimSpace(source))
+	if !ok || source == "" || key == "" {
+		return fmt.Errorf("invalid API key [%s]; expected source=value", v)
+	}
+	f[source] = key
+	return nil
+}
+
+// apiKeys holds API keys given on the command line
+var apiKeys = apiKeyFlag{}
+
+// legacyKeyVars are environment variables that were read before the
+// <SOURCE>_API_KEY convention and are still supported
+var legacyKeyVars = map[string]string{
+	"virustotal": "VT_API_KEY",
+}
+
+// loadAPIKey returns the API key for source: from -api-key if it was
+// given, otherwise from the <SOURCE>_API_KEY environment variable.
+// An empty string means there's no key.
+func loadAPIKey(source string) string {
+	if key, ok := apiKeys[source]; ok {
+		return key
+	}
+
+	if key := os.Getenv(strings.ToUpper(source) + "_API_KEY"); key != "" {
+		return key
+	}
+
+	if v, ok := legacyKeyVars[source]; ok {
+		return os.Getenv(v)
+	}
+	return ""
+}
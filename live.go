@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// checkLive sets the live field of each of ws to "live" or "gone",
+// depending on whether its URL can currently be fetched, checking up
+// to workers of them at once
+func checkLive(ctx context.Context, ws []wurl, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				limiter.acquire()
+				if isLive(ctx, ws[i].url) {
+					ws[i].live = "live"
+				} else {
+					ws[i].live = "gone"
+				}
+				limiter.release()
+			}
+		}()
+	}
+
+	for i := range ws {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// isLive reports whether u responds with a non-error status, after
+// following redirects. It's tried once, without retries, since a
+// URL that's gone will stay that way.
+func isLive(ctx context.Context, u string) bool {
+	status, err := liveStatus(ctx, u, http.MethodHead)
+	if err == nil && status == http.StatusMethodNotAllowed {
+		// some servers only answer GET
+		status, err = liveStatus(ctx, u, http.MethodGet)
+	}
+	if err != nil {
+		verbosef("live check for %s failed: %s", u, err)
+		return false
+	}
+	return status < 400
+}
+
+// liveStatus makes a request for u with the given method and
+// returns the status code of the response. The URLs are on hosts
+// found in the archives, so none of the -header values meant for
+// the sources (which can be credentials) are sent.
+func liveStatus(ctx context.Context, u, method string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsLiveSendsNoExtraHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	httpClient = srv.Client()
+	requestHeaders = headerFlag{"Authorization": {"Bearer secret"}, "Cookie": {"session=secret"}}
+	defer func() { requestHeaders = headerFlag{} }()
+
+	if !isLive(context.Background(), srv.URL) {
+		t.Fatal("want live, have gone")
+	}
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if v := got.Get(name); v != "" {
+			t.Errorf("live check sent %s: %s", name, v)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// verbose enables extra diagnostic output on stderr
+var verbose bool
+
+// quiet suppresses warnings and verbose output on stderr, leaving
+// only errors, so that a failing run still says why it failed
+var quiet bool
+
+// useColor enables colorized diagnostics on stderr. URLs written
+// to stdout are never colorized.
+var useColor bool
+
+const (
+	colorRed    = "\033[31m"
+	colorYellow = "\033[33m"
+	colorReset  = "\033[0m"
+)
+
+// wantColor reports whether diagnostics should be colorized: only when
+// stderr is a terminal, and neither -no-color nor NO_COLOR is set
+func wantColor(noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return isTerminal(os.Stderr)
+}
+
+// logf writes a diagnostic line to stderr in the given color
+func logf(color, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if useColor && color != "" {
+		msg = color + msg + colorReset
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// errorf writes an error to stderr
+func errorf(format string, args ...interface{}) {
+	logf(colorRed, format, args...)
+}
+
+// warnf writes a warning to stderr, unless quiet is set
+func warnf(format string, args ...interface{}) {
+	if quiet {
+		return
+	}
+	logf(colorYellow, format, args...)
+}
+
+// verbosef writes a diagnostic line to stderr, but
+// only when verbose output has been asked for
+func verbosef(format string, args ...interface{}) {
+	if !verbose || quiet {
+		return
+	}
+	logf("", format, args...)
+}
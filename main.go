@@ -2,15 +2,24 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,231 +30,1946 @@ func main() {
 	var dates bool
 	flag.BoolVar(&dates, "dates", false, "show date of fetch in the first column")
 
+	var rawTimestamp bool
+	flag.BoolVar(&rawTimestamp, "raw-timestamp", false, "with -dates, show the original YYYYMMDDhhmmss timestamp instead of an RFC3339 date (implies -dates)")
+
+	var bothTimestamps bool
+	flag.BoolVar(&bothTimestamps, "both-timestamps", false, "with -dates, show the RFC3339 date followed by the original timestamp (implies -dates)")
+
 	var noSubs bool
 	flag.BoolVar(&noSubs, "no-subs", false, "don't include subdomains of the target domain")
 
+	var dropUnparseable bool
+	flag.BoolVar(&dropUnparseable, "drop-unparseable", false, "drop URLs that can't be parsed or have no hostname")
+
+	var matchHostFlag string
+	flag.StringVar(&matchHostFlag, "match-host", "", "comma-separated list of exact hostnames to keep results for")
+
+	var maxDepth int
+	flag.IntVar(&maxDepth, "max-depth", -1, "only include URLs with at most this many path segments")
+
+	var minDepth int
+	flag.IntVar(&minDepth, "min-depth", 0, "only include URLs with at least this many path segments")
+
+	var includeExtensions string
+	flag.StringVar(&includeExtensions, "include-extensions", "", "comma-separated list of file extensions; only include URLs whose path ends in one of them")
+
+	var excludeExtensions string
+	flag.StringVar(&excludeExtensions, "exclude-extensions", "", "comma-separated list of file extensions; leave out URLs whose path ends in one of them")
+
+	var assumeHTTPS bool
+	flag.BoolVar(&assumeHTTPS, "assume-https", false, "prefix results that have no scheme with https://")
+
+	var assumeScheme string
+	flag.StringVar(&assumeScheme, "assume-scheme", "", "prefix results that have no scheme with this scheme instead: http or https (implies -assume-https)")
+
+	var ignoreFragment bool
+	flag.BoolVar(&ignoreFragment, "ignore-fragment", false, "remove #fragments from URLs before de-duplicating them")
+
+	var normalizeEncodingFlag bool
+	flag.BoolVar(&normalizeEncodingFlag, "normalize-encoding", false, "normalize percent-encoding in URLs before de-duplicating them")
+
+	var stripSessions bool
+	flag.BoolVar(&stripSessions, "strip-session-ids", false, "remove session ID parameters such as PHPSESSID and jsessionid from URLs before de-duplicating them")
+
+	var sessionParams string
+	flag.StringVar(&sessionParams, "session-params", "", "comma-separated list of extra query parameters for -strip-session-ids to remove (implies -strip-session-ids)")
+
+	var dropTracking bool
+	flag.BoolVar(&dropTracking, "drop-tracking", false, "remove tracking parameters such as utm_source, fbclid and gclid from URLs before de-duplicating them")
+
+	var dropParamsFlag string
+	flag.StringVar(&dropParamsFlag, "drop-params", "", "comma-separated list of query parameters to remove from URLs before de-duplicating them")
+
+	var trimQueryFlag bool
+	flag.BoolVar(&trimQueryFlag, "trim-query", false, "remove query strings and fragments from URLs before de-duplicating them")
+
+	var fuzzNumericFlag bool
+	flag.BoolVar(&fuzzNumericFlag, "fuzz-numeric", false, "replace purely numeric path segments with a placeholder before de-duplicating")
+
+	var fuzzPlaceholder string
+	flag.StringVar(&fuzzPlaceholder, "fuzz-placeholder", "FUZZ", "placeholder used by -fuzz-numeric")
+
+	var canonicalize bool
+	flag.BoolVar(&canonicalize, "canonicalize", false, "rewrite URLs into a canonical form before de-duplicating them (see the README for exactly what that does)")
+
+	var collapseWWWFlag bool
+	flag.BoolVar(&collapseWWWFlag, "collapse-www", false, "treat URLs that differ only by a leading www. on the host as duplicates")
+
+	var collapseIndexFlag bool
+	flag.BoolVar(&collapseIndexFlag, "collapse-index", false, "treat URLs that differ only by a trailing index.html (or similar) on the path as duplicates")
+
+	var indexNames string
+	flag.StringVar(&indexNames, "index-names", "", "comma-separated list of index filenames for -collapse-index to remove instead of the defaults (implies -collapse-index)")
+
+	var collapseSlashFlag bool
+	flag.BoolVar(&collapseSlashFlag, "collapse-slash", false, "treat URLs that differ only by a trailing slash on the path as duplicates")
+
+	var showDuplicates bool
+	flag.BoolVar(&showDuplicates, "show-duplicates", false, "report duplicate URLs on stderr along with the source that reported them")
+
+	var minYear int
+	flag.IntVar(&minYear, "min-year", 0, "only include captures from this year onwards")
+
+	var requireDate bool
+	flag.BoolVar(&requireDate, "require-date", false, "drop results that don't have a capture date")
+
+	var dedupLRUSize int
+	flag.IntVar(&dedupLRUSize, "dedup-lru-size", 0, "only remember this many recently seen URLs per domain when de-duplicating, to bound memory use (0 for no limit)")
+
+	var dedupWindow time.Duration
+	flag.Func("dedup-window", "keep repeat captures of a URL that are at least this far apart (e.g. 30d or 12h)", func(v string) error {
+		var err error
+		dedupWindow, err = parseDays(v)
+		return err
+	})
+
+	var noRedirects bool
+	flag.BoolVar(&noRedirects, "no-redirects", false, "drop captures that were 3xx redirects, from the sources that record status codes (Wayback Machine and Common Crawl)")
+
+	var onlyOK bool
+	flag.BoolVar(&onlyOK, "only-ok", false, "only include captures with a 2xx status code")
+
 	var getVersionsFlag bool
 	flag.BoolVar(&getVersionsFlag, "get-versions", false, "list URLs for crawled versions of input URL(s)")
 
+	var seedURLs string
+	flag.StringVar(&seedURLs, "seed-urls", "", "in get-versions mode, read the URLs to list versions of from this file instead of stdin")
+
+	var versionsMime string
+	flag.StringVar(&versionsMime, "versions-mime", "", "comma-separated list of mimetypes to keep in get-versions mode (e.g. text/html)")
+
+	var versionsStatus string
+	flag.StringVar(&versionsStatus, "versions-status", "", "comma-separated list of status codes to keep in get-versions mode (e.g. 200)")
+
+	flag.StringVar(&replayBase, "replay-base", replayBase, "base URL for the replay links listed in get-versions mode or written with -as-replay")
+
+	var asReplay bool
+	flag.BoolVar(&asReplay, "as-replay", false, "write a Wayback replay link for each URL the Wayback Machine has a capture of, instead of the URL itself")
+
+	var ordered bool
+	flag.BoolVar(&ordered, "ordered", false, "in get-versions mode, output results in input order instead of as they complete")
+
+	flag.Var(&cdxFilters, "cdx-filter", "server-side Wayback CDX filter such as statuscode:200 or !mimetype:warc/revisit (repeatable)")
+
+	var cdxURLList cdxURLFlag
+	flag.Var(&cdxURLList, "cdx-url", "Wayback CDX server endpoint to query instead of the default; repeat to list fallbacks, tried in order")
+
+	flag.StringVar(&cdxOutput, "cdx-output", "json", "format to request from the Wayback CDX server: json or text (smaller and faster to parse)")
+
+	var cdxFieldsFlag string
+	flag.StringVar(&cdxFieldsFlag, "cdx-fields", defaultCDXFields, "comma-separated names of the fields in Wayback CDX rows, in the order the server returns them")
+
+	flag.StringVar(&cdxCollapse, "collapse", "urlkey", "Wayback CDX collapse setting, e.g. urlkey, digest or timestamp:8 (one capture per day); empty to disable")
+
+	flag.IntVar(&cdxLimit, "cdx-limit", 0, "have the Wayback CDX server return at most this many captures per domain; negative values return the last N")
+
+	var inputFormat string
+	flag.StringVar(&inputFormat, "input-format", "lines", "format of the domain list on stdin: lines, csv or json")
+
+	var inputColumn string
+	flag.StringVar(&inputColumn, "input-column", "0", "with -input-format csv, the zero-based index or header name of the column holding domains")
+
+	var inputField string
+	flag.StringVar(&inputField, "input-field", "domain", "with -input-format json, the field holding the domain when the array contains objects")
+
+	var batchDomains bool
+	flag.BoolVar(&batchDomains, "batch-domains", false, "query related input domains through the domain they share, once, and split the results between them")
+
+	var strictInput bool
+	flag.BoolVar(&strictInput, "strict-input", false, "stop with an error on input that doesn't look like a domain, instead of skipping it")
+
+	var expandSubdomains bool
+	flag.BoolVar(&expandSubdomains, "expand-subdomains", false, "look up each domain's subdomains in certificate transparency logs first, and mark the URLs found for them")
+
+	var recurseHosts bool
+	flag.BoolVar(&recurseHosts, "recurse-hosts", false, "query hostnames that turn up in a domain's results, under the same parent domain, as domains of their own")
+
+	var recurseDepth int
+	flag.IntVar(&recurseDepth, "recurse-depth", 1, "with -recurse-hosts, how many rounds of newly discovered hosts to query")
+
+	var inputRegex string
+	flag.StringVar(&inputRegex, "input-regex", "", "regular expression whose first capture group extracts the domain from each line of input")
+
+	flag.StringVar(&inputType, "input-type", "domain", "type of input: domain or ip (ip is only supported by the virustotal source)")
+
+	flag.StringVar(&execSource, "exec-source", "", "command to run for each domain as an extra source; {{domain}} is replaced with the domain")
+
+	var sourcePriority string
+	flag.StringVar(&sourcePriority, "source-priority", "", "comma-separated list of sources, highest priority first, deciding which source's copy of a duplicate URL is kept")
+
+	var sourcesOrder string
+	flag.StringVar(&sourcesOrder, "sources-order", "", "comma-separated list of sources to start querying first, in order; the rest follow in the default order")
+
+	var ccSource string
+	flag.StringVar(&ccSource, "cc-source", "api", "Common Crawl backend: api (index server) or s3 (columnar cluster.idx and cdx segments)")
+
+	var ccYearsFlag string
+	flag.StringVar(&ccYearsFlag, "cc-years", "", "comma-separated list of years; query every Common Crawl crawl from them instead of the default crawl (api backend only)")
+
 	var sourcesFlag string
 	flag.StringVar(&sourcesFlag, "sources", "wayback,commoncrawl,virustotal", "comma-separated list of sources to query: wayback, commoncrawl, virustotal")
 
-	var outputFilePath string
-	flag.StringVar(&outputFilePath, "output", "", "output file path (default: stdout)")
+	var sequentialSources bool
+	flag.BoolVar(&sequentialSources, "sequential-sources", false, "query each domain's sources one at a time instead of all at once")
+
+	var stable bool
+	flag.BoolVar(&stable, "stable", false, "output results in the same order on every run: by source, in -sources-order order, then in the order each source returned them")
+
+	var outputFilePath string
+	flag.StringVar(&outputFilePath, "output", "", "output file path (default: stdout)")
+
+	var scanSecrets bool
+	flag.BoolVar(&scanSecrets, "scan-secrets", false, "check each URL for embedded secrets such as API keys and tokens")
+
+	var secretsOutputPath string
+	flag.StringVar(&secretsOutputPath, "secrets-output", "", "file to write secret matches to (default: stderr)")
+
+	var secretsRulesPath string
+	flag.StringVar(&secretsRulesPath, "secrets-rules", "", "file of extra '<name> <regex>' rules for -scan-secrets")
+
+	var summaryPath string
+	flag.StringVar(&summaryPath, "summary-json", "", "write a JSON summary of the run to this path once it's finished")
+
+	var annotateLive bool
+	flag.BoolVar(&annotateLive, "annotate-live", false, "check whether each URL can still be fetched, and mark it [live] or [gone]")
+
+	flag.StringVar(&rawDumpDir, "raw-dump", "", "directory to save each source's raw responses to, as <domain>.<source>.<ext>")
+
+	var hostStats bool
+	flag.BoolVar(&hostStats, "host-stats", false, "after each domain, print the number of URLs found for each hostname to stderr")
+
+	var sizeHistogramFlag bool
+	flag.BoolVar(&sizeHistogramFlag, "size-histogram", false, "after each domain, print a histogram of archived response sizes to stderr")
+
+	var withDigest bool
+	flag.BoolVar(&withDigest, "with-digest", false, "show the content digest of each capture before the URL (Wayback Machine only)")
+
+	var interactive bool
+	flag.BoolVar(&interactive, "interactive", false, "browse, filter and export the results for a single domain interactively")
+
+	var jsonOutput bool
+	flag.BoolVar(&jsonOutput, "json", false, "output one JSON object per URL instead of plain text")
+
+	var jsonMeta bool
+	flag.BoolVar(&jsonMeta, "json-meta", false, "start -json output with a line describing its schema version (implies -json)")
+
+	var errorsInStream bool
+	flag.BoolVar(&errorsInStream, "errors-in-stream", false, "with -json, write a record for each failed fetch to the output alongside the URLs")
+
+	var print0 bool
+	flag.BoolVar(&print0, "print0", false, "end each line of text output with a NUL byte instead of a newline, for xargs -0")
+
+	var linePrefix string
+	flag.StringVar(&linePrefix, "prefix", "", "string to add before each output URL (text output only)")
+
+	var lineSuffix string
+	flag.StringVar(&lineSuffix, "suffix", "", "string to add after each output URL (text output only)")
+
+	var maxPerHost int
+	flag.IntVar(&maxPerHost, "max-per-host", 0, "output at most this many URLs for each hostname of each domain (0 for no limit)")
+
+	var newHostsOnly bool
+	flag.BoolVar(&newHostsOnly, "new-hosts-only", false, "only output the first URL seen for each hostname across the whole run")
+
+	var withCount bool
+	flag.BoolVar(&withCount, "with-count", false, "output the number of captures of each URL as '<count>\t<url>'")
+
+	var dateRange bool
+	flag.BoolVar(&dateRange, "date-range", false, "output the first and last capture dates of each URL as '<first> <last> <url>'")
+
+	var flushMode string
+	flag.StringVar(&flushMode, "flush-mode", "stream", "when results are written: stream (as they arrive), domain (after each domain) or end (after the whole run)")
+
+	var groupByHostFlag bool
+	flag.BoolVar(&groupByHostFlag, "group-by-host", false, "sort each domain's URLs by host and path, with a blank line between hosts")
+
+	var hostHeaders bool
+	flag.BoolVar(&hostHeaders, "host-headers", false, "with -group-by-host, separate hosts with a '# host' header instead of a blank line")
+
+	var tee bool
+	flag.BoolVar(&tee, "tee", false, "write output to stdout as well as the -output file")
+
+	var flushInterval time.Duration
+	flag.DurationVar(&flushInterval, "flush-interval", 0, "buffer output, and write it out at least this often (e.g. 5s) and after each domain")
+
+	var splitBySource string
+	flag.StringVar(&splitBySource, "split-by-source", "", "also write each source's URLs to <dir>/<source>.txt, de-duplicated separately")
+
+	var appendOutput bool
+	flag.BoolVar(&appendOutput, "append", false, "append to the -output file instead of overwriting it")
+
+	var gzipOutput bool
+	flag.BoolVar(&gzipOutput, "gzip-output", false, "gzip-compress the output file and add a .gz extension (requires -output)")
+
+	concurrency := concurrencyFlag{n: 5}
+	flag.Var(&concurrency, "concurrency", "number of concurrent requests, or auto to start from the number of CPUs and adapt to rate limiting")
+
+	flag.IntVar(&concurrencyMax, "concurrency-max", concurrencyMax, "with -concurrency auto, the most concurrent requests to allow")
+	flag.Float64Var(&concurrencyIncrease, "concurrency-increase", concurrencyIncrease, "with -concurrency auto, how much to raise the limit after each successful request")
+	flag.Float64Var(&concurrencyDecrease, "concurrency-decrease", concurrencyDecrease, "with -concurrency auto, the factor to multiply the limit by after each 429 response")
+
+	var timeout int
+	flag.IntVar(&timeout, "timeout", 10, "HTTP request timeout in seconds")
+
+	var minInterval time.Duration
+	flag.DurationVar(&minInterval, "min-interval", 0, "leave at least this long between the starts of requests to the same host (e.g. 500ms)")
+
+	var proxyFile string
+	flag.StringVar(&proxyFile, "proxy-file", "", "file of proxy URLs, one per line, to spread requests across")
+
+	var proxyStrategy string
+	flag.StringVar(&proxyStrategy, "proxy-strategy", "round-robin", "how -proxy-file proxies are chosen for each request: round-robin or random")
+
+	var http2 bool
+	flag.BoolVar(&http2, "http2", true, "use HTTP/2 with servers that support it; -http2=false forces HTTP/1.1, e.g. for proxies that mishandle HTTP/2")
+
+	flag.BoolVar(&verbose, "verbose", false, "print extra diagnostic information to stderr")
+	var trace bool
+	flag.BoolVar(&trace, "trace", false, "log every HTTP request and response to stderr")
+
+	flag.BoolVar(&quiet, "quiet", false, "don't print warnings or other diagnostics to stderr, only errors")
+
+	var connectTimeout int
+	flag.IntVar(&connectTimeout, "connect-timeout", 0, "timeout in seconds for establishing connections, separate from -timeout (0 for no separate limit)")
+
+	var maxBodyMB int64
+	flag.Int64Var(&maxBodyMB, "max-body-size", 512, "maximum size of a response body in MB (0 for no limit)")
+
+	flag.Var(apiKeys, "api-key", "API key for a source as source=value, overriding its <SOURCE>_API_KEY environment variable (repeatable)")
+
+	flag.Var(requestHeaders, "header", "extra 'Name: Value' header to send with every request (repeatable)")
+
+	flag.Var(retriesFlag{}, "retries", "number of times to retry a request after a network error, rate limiting or a server error; per-source counts can be given as e.g. wayback=5,virustotal=1 (default 2)")
+
+	flag.BoolVar(&retryEmpty, "retry-empty", false, "retry wayback and commoncrawl when they return no results, which can happen under load")
+
+	flag.IntVar(&maxDomainFailures, "max-domain-failures", 0, "stop querying a source for a domain after this many consecutive failed requests (0 to disable)")
+
+	var failFast bool
+	flag.BoolVar(&failFast, "fail-fast", false, "exit with a non-zero status on the first fetch error from any source")
+
+	var maxErrors int
+	flag.IntVar(&maxErrors, "max-errors", 0, "stop with a non-zero status once more than this many fetch errors have happened across the run (0 for no limit)")
+
+	var sinceLastRun string
+	flag.StringVar(&sinceLastRun, "since-last-run", "", "state file whose modification time limits Wayback results to captures since the last run; it's updated when the run succeeds")
+
+	var failOnEmpty bool
+	flag.BoolVar(&failOnEmpty, "fail-on-empty", false, "exit with a non-zero status if no URLs were found for any of the inputs")
+
+	var cpuProfile string
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "write a CPU profile to this file")
+
+	var memProfile string
+	flag.StringVar(&memProfile, "memprofile", "", "write a memory profile to this file when the run finishes")
+
+	var noColor bool
+	flag.BoolVar(&noColor, "no-color", false, "don't colorize diagnostics on stderr")
+
+	flag.Parse()
+
+	useColor = wantColor(noColor)
+
+	switch assumeScheme {
+	case "":
+		if assumeHTTPS {
+			assumeScheme = "https"
+		}
+	case "http", "https":
+	default:
+		errorf("invalid -assume-scheme [%s]. Please choose from: http, https", assumeScheme)
+		os.Exit(1)
+	}
+
+	// -canonicalize turns on the related normalizations, except
+	// for any that have explicitly been turned off
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	canonicalWWW := canonicalize && (collapseWWWFlag || !explicit["collapse-www"])
+	canonicalSlash := canonicalize && (collapseSlashFlag || !explicit["collapse-slash"])
+	if canonicalize && !explicit["ignore-fragment"] {
+		ignoreFragment = true
+	}
+
+	var sessionParamSet map[string]bool
+	if stripSessions || sessionParams != "" {
+		sessionParamSet = commaSet(strings.ToLower(sessionParams))
+		for _, p := range defaultSessionParams {
+			sessionParamSet[p] = true
+		}
+	}
+
+	var indexNameSet map[string]bool
+	if collapseIndexFlag || indexNames != "" {
+		indexNameSet = commaSet(strings.ToLower(indexNames))
+		if indexNames == "" {
+			for _, n := range defaultIndexNames {
+				indexNameSet[n] = true
+			}
+		}
+	}
+
+	var dropParamSet map[string]bool
+	if dropTracking || dropParamsFlag != "" {
+		dropParamSet = commaSet(strings.ToLower(dropParamsFlag))
+		if dropTracking {
+			for _, p := range defaultTrackingParams {
+				dropParamSet[p] = true
+			}
+		}
+	}
+
+	if quiet && verbose {
+		errorf("-quiet and -verbose can't be used together")
+		os.Exit(1)
+	}
+
+	stopProfiling, err := startProfiling(cpuProfile, memProfile)
+	if err != nil {
+		errorf("failed to start profiling: %s", err)
+		os.Exit(1)
+	}
+	defer stopProfiling()
+
+	summary := newRunSummary()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// in fail-fast mode the first error cancels every in-flight
+	// request and is the only one reported
+	var failOnce sync.Once
+	failed := false
+	fail := func(err error) {
+		failOnce.Do(func() {
+			errorf("fetch failed: %s", err)
+			failed = true
+			cancel()
+		})
+	}
+
+	// fetchFailed handles a fetch error, giving up on the whole run
+	// straight away with -fail-fast, or once there have been more
+	// than -max-errors of them
+	var errorCount int32
+	fetchFailed := func(err error) {
+		if failFast {
+			fail(err)
+			return
+		}
+		if maxErrors > 0 && atomic.AddInt32(&errorCount, 1) > int32(maxErrors) {
+			fail(fmt.Errorf("giving up after more than %d errors, the last of which was: %w", maxErrors, err))
+		}
+	}
+
+	if print0 && (jsonOutput || jsonMeta) {
+		errorf("-print0 can't be used with -json")
+		os.Exit(1)
+	}
+
+	// lineEnd ends each entry of text output
+	lineEnd := "\n"
+	if print0 {
+		lineEnd = "\x00"
+	}
+
+	if gzipOutput && outputFilePath == "" {
+		errorf("-gzip-output requires an output file to be set with -output")
+		os.Exit(1)
+	}
+
+	if appendOutput && (outputFilePath == "" || gzipOutput) {
+		errorf("-append requires an output file to be set with -output, and can't be used with -gzip-output")
+		os.Exit(1)
+	}
+
+	if tee && outputFilePath == "" {
+		errorf("-tee requires an output file to be set with -output")
+		os.Exit(1)
+	}
+
+	if dateRange && withCount {
+		errorf("-date-range can't be combined with -with-count")
+		os.Exit(1)
+	}
+
+	switch inputFormat {
+	case "lines", "csv", "json":
+	default:
+		errorf("invalid -input-format [%s]. Please choose from: lines, csv, json", inputFormat)
+		os.Exit(1)
+	}
+
+	var secretRules []secretRule
+	var secretsOutput io.Writer = os.Stderr
+	if scanSecrets {
+		secretRules = defaultSecretRules
+		if secretsRulesPath != "" {
+			extra, err := loadSecretRules(secretsRulesPath)
+			if err != nil {
+				errorf("failed to load secrets rules: %s", err)
+				os.Exit(1)
+			}
+			secretRules = append(secretRules, extra...)
+		}
+
+		if secretsOutputPath != "" {
+			f, err := os.Create(secretsOutputPath)
+			if err != nil {
+				errorf("failed to create secrets output file: %s", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			secretsOutput = f
+		}
+	}
+
+	// the state file is only touched at the end of a successful run,
+	// with the time the run started, so nothing captured while it was
+	// going on is missed next time
+	runStart := time.Now()
+	if sinceLastRun != "" {
+		info, err := os.Stat(sinceLastRun)
+		switch {
+		case err == nil:
+			cdxFrom = info.ModTime().UTC().Format("20060102150405")
+			verbosef("fetching Wayback captures since %s", info.ModTime().Format(time.RFC3339))
+		case errors.Is(err, os.ErrNotExist):
+			verbosef("%s doesn't exist yet, fetching all captures", sinceLastRun)
+		default:
+			errorf("failed to read -since-last-run state file: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(cdxURLList) > 0 {
+		cdxURLs = cdxURLList
+	}
+
+	if cdxOutput != "json" && cdxOutput != "text" {
+		errorf("invalid -cdx-output [%s]. Please choose from: json, text", cdxOutput)
+		os.Exit(1)
+	}
+
+	cdxFields, err = parseCDXFields(cdxFieldsFlag)
+	if err != nil {
+		errorf("invalid -cdx-fields [%s]: %s", cdxFieldsFlag, err)
+		os.Exit(1)
+	}
+
+	if cdxCollapse != "" && !cdxCollapseRe.MatchString(cdxCollapse) {
+		errorf("invalid -collapse [%s]; expected a CDX field with an optional prefix length, e.g. urlkey or timestamp:8", cdxCollapse)
+		os.Exit(1)
+	}
+
+	if concurrencyIncrease < 0 || concurrencyDecrease <= 0 || concurrencyDecrease >= 1 {
+		errorf("-concurrency-increase must not be negative, and -concurrency-decrease must be between 0 and 1")
+		os.Exit(1)
+	}
+
+	var workers int
+	limiter, workers = newLimiter(concurrency)
+	if concurrency.auto {
+		verbosef("starting with a concurrency of %d, up to %d", int(limiter.limit), workers)
+	}
+
+	transport := newTransport(time.Duration(connectTimeout)*time.Second, http2)
+
+	maxBodySize = maxBodyMB * 1024 * 1024
+
+	if rawDumpDir != "" {
+		if err := os.MkdirAll(rawDumpDir, 0755); err != nil {
+			errorf("failed to create -raw-dump directory: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if proxyFile != "" {
+		proxies, err := loadProxies(proxyFile)
+		if err != nil {
+			errorf("failed to load proxies: %s", err)
+			os.Exit(1)
+		}
+		pool, err := newProxyPool(transport, proxies, proxyStrategy)
+		if err != nil {
+			errorf("%s", err)
+			os.Exit(1)
+		}
+		roundTripper = pool
+	}
+	if minInterval > 0 {
+		roundTripper = newSpacedTransport(roundTripper, minInterval)
+	}
+	if trace {
+		roundTripper = &tracingTransport{next: roundTripper}
+	}
+
+	// Initialize the global HTTP client with a timeout
+	httpClient = &http.Client{
+		Timeout:   time.Duration(timeout) * time.Second,
+		Transport: roundTripper,
+	}
+
+	if seedURLs != "" && !getVersionsFlag {
+		errorf("-seed-urls only applies to -get-versions mode")
+		os.Exit(1)
+	}
+
+	if flag.NArg() > 0 {
+		// fetch for a single domain
+		domains = []string{flag.Arg(0)}
+	} else if seedURLs != "" {
+		var err error
+		domains, err = readSeedURLs(seedURLs)
+		if err != nil {
+			errorf("failed to read -seed-urls: %s", err)
+			os.Exit(1)
+		}
+	} else {
+
+		// with no argument and nothing piped in, scanning stdin
+		// would just sit there waiting for the user to type
+		if isTerminal(os.Stdin) {
+			errorf("no domains provided: pass a domain as an argument or pipe a list on stdin")
+			fmt.Fprintln(os.Stderr)
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		// fetch for all domains from stdin
+		var err error
+		domains, err = readDomains(os.Stdin, inputFormat, inputColumn, inputField)
+		if err != nil {
+			errorf("failed to read input: %s", err)
+			os.Exit(1)
+		}
+
+		if inputRegex != "" {
+			re, err := regexp.Compile(inputRegex)
+			if err != nil {
+				errorf("invalid -input-regex [%s]: %s", inputRegex, err)
+				os.Exit(1)
+			}
+			domains = extractDomains(domains, re)
+		}
+	}
+
+	// Determine which sources to use
+	sources := make(map[string]bool)
+	for _, s := range strings.Split(sourcesFlag, ",") {
+		sources[strings.TrimSpace(s)] = true
+	}
+
+	var fetchFns []source
+	if sources["wayback"] {
+		fetchFns = append(fetchFns, source{"wayback", getWaybackURLs})
+	}
+	if sources["commoncrawl"] {
+		if ccYearsFlag != "" {
+			ccYears = commaSet(ccYearsFlag)
+			for y := range ccYears {
+				if !ccYearRe.MatchString(y) {
+					errorf("invalid -cc-years entry [%s]; expected a comma-separated list of years, e.g. 2023,2024", y)
+					os.Exit(1)
+				}
+			}
+			if ccSource != "api" {
+				errorf("-cc-years only works with -cc-source api")
+				os.Exit(1)
+			}
+		}
+
+		switch ccSource {
+		case "api":
+			fetchFns = append(fetchFns, source{"commoncrawl", getCommonCrawlURLs})
+		case "s3":
+			fetchFns = append(fetchFns, source{"commoncrawl", getCommonCrawlS3URLs})
+		default:
+			errorf("invalid -cc-source [%s]. Please choose from: api, s3", ccSource)
+			os.Exit(1)
+		}
+	}
+	if sources["virustotal"] {
+		fetchFns = append(fetchFns, source{"virustotal", getVirusTotalURLs})
+	}
+
+	if execSource != "" {
+		execTimeout = time.Duration(timeout) * time.Second
+		fetchFns = append(fetchFns, source{"exec", getExecURLs})
+	}
+
+	switch inputType {
+	case "domain":
+	case "ip":
+		// only VirusTotal can look up URLs by IP address
+		var ipFns []source
+		for _, src := range fetchFns {
+			if src.name != "virustotal" {
+				warnf("%s can't be queried by IP address, skipping it", src.name)
+				continue
+			}
+			ipFns = append(ipFns, src)
+		}
+		fetchFns = ipFns
+	default:
+		errorf("invalid -input-type [%s]. Please choose from: domain, ip", inputType)
+		os.Exit(1)
+	}
+
+	if len(fetchFns) == 0 && !getVersionsFlag {
+		errorf("no valid sources specified. Please choose from: wayback, commoncrawl, virustotal")
+		os.Exit(1)
+	}
+
+	matchHosts := commaSet(strings.ToLower(matchHostFlag))
+	includeExts := extensionSet(includeExtensions)
+	excludeExts := extensionSet(excludeExtensions)
+
+	priority, err := parseSourcePriority(sourcePriority)
+	if err != nil {
+		errorf("%s", err)
+		os.Exit(1)
+	}
+
+	fetchFns, err = orderSources(fetchFns, sourcesOrder)
+	if err != nil {
+		errorf("%s", err)
+		os.Exit(1)
+	}
+
+	if expandSubdomains && (noSubs || inputType == "ip") {
+		errorf("-expand-subdomains can't be used with -no-subs or -input-type ip")
+		os.Exit(1)
+	}
+
+	// -get-versions takes URLs rather than domains
+	if !getVersionsFlag {
+		domains, err = validateInputs(domains, inputType, strictInput)
+		if err != nil {
+			errorf("%s", err)
+			os.Exit(1)
+		}
+	}
+
+	if batchDomains && inputType == "domain" {
+		var batched []string
+		for _, d := range domains {
+			if d, _, err := splitWildcard(d); err == nil {
+				batched = append(batched, d)
+			}
+		}
+
+		b := newDomainBatcher(batched)
+		for i, src := range fetchFns {
+			fetchFns[i] = b.wrap(src)
+		}
+	}
+
+	if interactive {
+		// results are exported from the prompt rather than written out
+		if outputFilePath != "" {
+			errorf("-interactive can't be used with -output; export results from the prompt with e <file> instead")
+			os.Exit(1)
+		}
+		if flag.NArg() == 0 || !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+			errorf("-interactive needs a domain argument, and stdin and stdout to be a terminal")
+			os.Exit(1)
+		}
+		// every result is needed before browsing can start
+		flushMode = "end"
+	}
+
+	switch flushMode {
+	case "stream":
+		// grouping, prioritising sources, checking URLs concurrently,
+		// counting captures and finding the latest one need at least
+		// a whole domain's results
+		if groupByHostFlag || len(priority) > 0 || annotateLive || withCount || dateRange || asReplay {
+			flushMode = "domain"
+		}
+	case "domain", "end":
+	default:
+		errorf("invalid -flush-mode [%s]. Please choose from: stream, domain, end", flushMode)
+		os.Exit(1)
+	}
+
+	if errorsInStream && !jsonOutput && !jsonMeta {
+		errorf("-errors-in-stream requires -json")
+		os.Exit(1)
+	}
+
+	var splitFiles *sourceFiles
+	if splitBySource != "" {
+		var err error
+		splitFiles, err = newSourceFiles(splitBySource)
+		if err != nil {
+			errorf("failed to create -split-by-source directory: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	// everything that can fail is checked before the output file is
+	// created, so that a mistake doesn't truncate an existing one
+	if gzipOutput && !strings.HasSuffix(outputFilePath, ".gz") {
+		outputFilePath += ".gz"
+	}
+
+	var outputFile *os.File
+	if appendOutput {
+		var err error
+		outputFile, err = openAppend(outputFilePath, lineEnd[0])
+		if err != nil {
+			errorf("failed to open output file: %s", err)
+			os.Exit(1)
+		}
+	} else if outputFilePath != "" {
+		var err error
+		outputFile, err = os.Create(outputFilePath)
+		if err != nil {
+			errorf("failed to create output file: %s", err)
+			os.Exit(1)
+		}
+	} else {
+		outputFile = os.Stdout
+	}
+
+	var output io.Writer = outputFile
+	var gz *gzip.Writer
+	if gzipOutput {
+		gz = gzip.NewWriter(outputFile)
+		output = gz
+	}
+
+	// stdout always gets the plain text, even if the file is compressed
+	if tee && outputFile != os.Stdout {
+		output = io.MultiWriter(output, os.Stdout)
+	}
+
+	// with -flush-interval, output is buffered, and flushed on a
+	// timer and after each domain; the gzip writer is flushed too,
+	// so that what's been written so far can be decompressed
+	var bw *bufio.Writer
+	if flushInterval > 0 {
+		bw = bufio.NewWriter(output)
+		output = bw
+	}
+	sw := &syncWriter{w: output}
+	if bw != nil {
+		sw.flushers = append(sw.flushers, bw)
+		if gz != nil {
+			sw.flushers = append(sw.flushers, gz)
+		}
+	}
+	output = sw
+
+	stopFlushing := func() {}
+	if flushInterval > 0 {
+		ticker := time.NewTicker(flushInterval)
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					if err := sw.Flush(); err != nil {
+						errorf("failed to write output: %s", err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		var once sync.Once
+		stopFlushing = func() {
+			once.Do(func() {
+				ticker.Stop()
+				close(done)
+			})
+		}
+	}
+
+	if rawTimestamp || bothTimestamps {
+		dates = true
+	}
+
+	// closeOutput must run on every exit path so that the
+	// gzip trailer is written and the file is complete
+	closeOutput := func() {
+		stopFlushing()
+		if err := sw.Flush(); err != nil {
+			errorf("failed to write output: %s", err)
+		}
+		if gz != nil {
+			if err := gz.Close(); err != nil {
+				errorf("failed to write output file: %s", err)
+			}
+		}
+		if outputFile != os.Stdout {
+			outputFile.Close()
+		}
+		if splitFiles != nil {
+			if err := splitFiles.close(); err != nil {
+				errorf("failed to write -split-by-source files: %s", err)
+			}
+		}
+	}
+	defer closeOutput()
+
+	if gzipOutput {
+		// stop cleanly on ctrl-c rather than leaving a truncated
+		// gzip stream behind; a second ctrl-c still kills us
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+	}
+
+	// get-versions mode
+	if getVersionsFlag {
+
+		filter := versionsFilter{
+			mimes:    commaSet(strings.ToLower(versionsMime)),
+			statuses: commaSet(versionsStatus),
+		}
+
+		emitted := 0
+		emit := func(r versionsResult) {
+			if r.err != nil {
+				fetchFailed(r.err)
+				return
+			}
+			for _, v := range r.versions {
+				fmt.Fprint(output, linePrefix+v+lineSuffix+lineEnd)
+			}
+			emitted += len(r.versions)
+		}
+
+		// results arrive in whatever order the workers finish; when
+		// ordering is wanted they're held back until every earlier
+		// input has been written
+		pending := make(map[int]versionsResult)
+		next := 0
+		for r := range fetchAllVersions(ctx, domains, filter, workers) {
+			if !ordered {
+				emit(r)
+				continue
+			}
+
+			pending[r.index] = r
+			for {
+				p, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				emit(p)
+				next++
+			}
+		}
+
+		empty := failOnEmpty && emitted == 0
+		if empty {
+			errorf("no versions found")
+		}
+
+		if failed || ctx.Err() != nil || empty {
+			closeOutput()
+			stopProfiling()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if jsonMeta {
+		jsonOutput = true
+		if err := writeJSONMeta(output); err != nil {
+			errorf("failed to write output: %s", err)
+		}
+	}
+
+	jsonEnc := json.NewEncoder(output)
+
+	// digestOf is the digest to write for w, if any
+	digestOf := func(w wurl) string {
+		if !withDigest {
+			return ""
+		}
+		return w.digest
+	}
+
+	// replayOf is the Wayback replay link to write for w, if any, to
+	// its latest capture; only the Wayback Machine's own captures are
+	// known to be there
+	replayOf := func(w wurl) string {
+		if !asReplay || w.replay == nil || w.replay.last == "" {
+			return ""
+		}
+		return fmt.Sprintf("%s/%s/%s", strings.TrimRight(replayBase, "/"), w.replay.last, w.url)
+	}
+
+	lines := lineFormat{
+		prefix:         linePrefix,
+		suffix:         lineSuffix,
+		end:            lineEnd,
+		digest:         withDigest,
+		live:           annotateLive,
+		dates:          dates,
+		rawTimestamp:   rawTimestamp,
+		bothTimestamps: bothTimestamps,
+	}
+
+	writeCount := func(count int, w wurl) {
+		if jsonOutput {
+			err := jsonEnc.Encode(jsonRecord{
+				URL:    w.url,
+				Source: w.source,
+				Count:  count,
+			})
+			if err != nil {
+				errorf("failed to write output: %s", err)
+			}
+			return
+		}
+
+		fmt.Fprintf(output, "%d\t%s%s", count, linePrefix+w.url+lineSuffix, lineEnd)
+	}
+
+	writeRange := func(r *captureRange, w wurl) {
+		if jsonOutput {
+			err := jsonEnc.Encode(jsonRecord{
+				URL:       w.url,
+				Source:    w.source,
+				FirstSeen: r.first,
+				LastSeen:  r.last,
+			})
+			if err != nil {
+				errorf("failed to write output: %s", err)
+			}
+			return
+		}
+
+		format := func(date string) string {
+			d, err := time.Parse("20060102150405", date)
+			if err != nil {
+				return "-"
+			}
+			return d.Format(time.RFC3339)
+		}
+		fmt.Fprint(output, format(r.first)+" "+format(r.last)+" "+linePrefix+w.url+lineSuffix+lineEnd)
+	}
+
+	writeURL := func(w wurl) {
+		switch {
+		case dateRange:
+			writeRange(w.span, w)
+			return
+		case withCount:
+			writeCount(w.count, w)
+			return
+		}
+
+		if jsonOutput {
+			err := jsonEnc.Encode(jsonRecord{
+				URL:        w.url,
+				Timestamp:  w.date,
+				Source:     w.source,
+				Status:     w.status,
+				Digest:     digestOf(w),
+				Replay:     replayOf(w),
+				Live:       w.live,
+				PassiveDNS: w.passiveDNS,
+			})
+			if err != nil {
+				errorf("failed to write output: %s", err)
+			}
+			return
+		}
+
+		u := w.url
+		if r := replayOf(w); r != "" {
+			u = r
+		}
+		fmt.Fprint(output, lines.format(w, u))
+	}
+
+	// writeError writes an -errors-in-stream record for a failed fetch.
+	// It's called from the source goroutines, so it writes the record
+	// in one go rather than through jsonEnc.
+	writeError := func(domain, source string, err error) {
+		b, merr := json.Marshal(errorRecord{Error: true, Domain: domain, Source: source, Message: err.Error()})
+		if merr != nil {
+			errorf("failed to write output: %s", merr)
+			return
+		}
+		if _, werr := output.Write(append(b, '\n')); werr != nil {
+			errorf("failed to write output: %s", werr)
+		}
+	}
+
+	// buffered holds the results waiting to be written when
+	// they're not being streamed out as they arrive
+	var buffered []wurl
+	flush := func() {
+		if annotateLive {
+			checkLive(ctx, buffered, workers)
+		}
+
+		if !groupByHostFlag {
+			for _, w := range buffered {
+				writeURL(w)
+			}
+			buffered = nil
+			return
+		}
+
+		for i, g := range groupByHost(buffered) {
+			if jsonOutput || print0 {
+				// separators would break up the JSON lines, or
+				// turn into bogus entries between NULs
+			} else if hostHeaders {
+				fmt.Fprintf(output, "# %s\n", g.host)
+			} else if i > 0 {
+				fmt.Fprintln(output)
+			}
+			for _, w := range g.urls {
+				writeURL(w)
+			}
+		}
+		buffered = nil
+	}
+
+	// hostsSeen holds every hostname output so far across all domains
+	hostsSeen := make(map[string]bool)
+
+	// with -recurse-hosts, every domain queued so far, and how many
+	// rounds of discovery away from the input each one is
+	queued := make(map[string]bool)
+	recurseLevel := make(map[string]int)
+	for _, d := range domains {
+		queued[strings.ToLower(d)] = true
+	}
+
+	// domains can grow as hosts are discovered, so it's
+	// indexed rather than ranged over
+	for i := 0; i < len(domains); i++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		input := domains[i]
+		domain, subsOnly, err := splitWildcard(input)
+		if err != nil {
+			errorf("%s", err)
+			continue
+		}
+
+		// a wildcard asks for subdomains, whatever -no-subs says
+		noSubs := noSubs && !subsOnly
+
+		// with -expand-subdomains, the subdomains known from passive
+		// DNS, and how many URLs have been found for each
+		var known map[string]int
+		if expandSubdomains {
+			subs, err := lookupSubdomains(ctx, domain)
+			if err != nil {
+				warnf("failed to look up subdomains of %s: %s", domain, err)
+			} else {
+				known = make(map[string]int, len(subs))
+				for _, sub := range subs {
+					known[sub] = 0
+				}
+			}
+		}
+
+		var wg sync.WaitGroup
+		wurls := make(chan wurl)
+
+		summary.addDomain(input)
+
+		// fetch gets one source's results and sends them on wurls,
+		// once wait (if it's not nil) has been closed
+		fetch := func(src source, wait <-chan struct{}) {
+			resp, err := fetchSource(withBreaker(ctx, domain, src.name), src, domain, noSubs)
+			limiter.release()
+			if wait != nil {
+				<-wait
+			}
+			if err != nil {
+				summary.addError(input, src.name, err)
+				if errorsInStream {
+					writeError(input, src.name, err)
+				}
+				fetchFailed(err)
+				return
+			}
+			for _, r := range resp {
+				if assumeScheme != "" {
+					r.url = addScheme(r.url, assumeScheme)
+				}
+				if noSubs && isSubdomain(r.url, domain) {
+					continue
+				}
+				if subsOnly && !isSubdomain(r.url, domain) {
+					continue
+				}
+				r.source = src.name
+				wurls <- r
+			}
+		}
+
+		if sequentialSources {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, src := range fetchFns {
+					if ctx.Err() != nil {
+						break
+					}
+					limiter.acquire()
+					fetch(src, nil)
+				}
+			}()
+		} else {
+			// with -stable, each source waits for the one before it
+			// to finish sending before it sends its own results
+			var prev chan struct{}
+
+			for _, src := range fetchFns {
+				wg.Add(1)
+				src := src
+
+				var wait, done chan struct{}
+				if stable {
+					wait = prev
+					done = make(chan struct{})
+					prev = done
+				}
+
+				// acquiring here rather than in the goroutine means
+				// sources start in the order they're listed in
+				limiter.acquire()
+				go func() {
+					defer wg.Done()
+					if done != nil {
+						defer close(done)
+					}
+					fetch(src, wait)
+				}()
+			}
+		}
+
+		go func() {
+			wg.Wait()
+			close(wurls)
+		}()
+
+		seen := newSeenSet(dedupLRUSize)
+		windowed := newWindowDeduper(dedupWindow)
+		dropped := 0
+
+		// with -date-range, the span of capture dates for each key
+		ranges := make(map[string]*captureRange)
+
+		// with -as-replay, the span of Wayback capture dates for each key,
+		// so that the link can be to the latest
+		replays := make(map[string]*captureRange)
+
+		// with -max-per-host, the number of URLs output for each hostname
+		perHost := make(map[string]int)
+
+		// with -recurse-hosts, the hosts found to query next
+		var discovered []string
+		recurse := recurseHosts && recurseLevel[input] < recurseDepth
+
+		// bufferedIdx maps de-duplication keys to their position in buffered
+		bufferedIdx := make(map[string]int)
+
+		var sizes *sizeHistogram
+		if sizeHistogramFlag {
+			sizes = newSizeHistogram()
+		}
+
+		// with -host-stats, the number of URLs output for each hostname
+		var hostCounts map[string]int
+		if hostStats {
+			hostCounts = make(map[string]int)
+		}
+		for w := range wurls {
+			if dropUnparseable {
+				if u, err := url.Parse(w.url); err != nil || u.Hostname() == "" {
+					dropped++
+					continue
+				}
+			}
+
+			if trimQueryFlag {
+				w.url = trimQuery(w.url)
+			}
+			if ignoreFragment {
+				w.url = stripFragment(w.url)
+			}
+			if normalizeEncodingFlag {
+				w.url = normalizeEncoding(w.url)
+			}
+			if sessionParamSet != nil {
+				w.url = stripSessionIDs(w.url, sessionParamSet)
+			}
+			if dropParamSet != nil {
+				w.url = dropParams(w.url, dropParamSet)
+			}
+			if canonicalize {
+				w.url = canonicalURL(w.url, canonicalWWW, canonicalSlash)
+			}
+			if fuzzNumericFlag {
+				w.url = fuzzNumeric(w.url, fuzzPlaceholder)
+			}
+
+			if len(matchHosts) > 0 {
+				u, err := url.Parse(w.url)
+				if err != nil || !matchHosts[strings.ToLower(u.Hostname())] {
+					continue
+				}
+			}
+
+			if maxDepth >= 0 || minDepth > 0 {
+				// URLs that can't be parsed have no known depth,
+				// so err on the side of including them
+				if u, err := url.Parse(w.url); err == nil {
+					depth := pathDepth(u)
+					if maxDepth >= 0 && depth > maxDepth || depth < minDepth {
+						continue
+					}
+				}
+			}
+
+			if len(includeExts) > 0 || len(excludeExts) > 0 {
+				if !keepExtension(w.url, includeExts, excludeExts) {
+					continue
+				}
+			}
+
+			if noRedirects && strings.HasPrefix(w.status, "3") {
+				continue
+			}
+
+			if onlyOK && w.status != "" && !strings.HasPrefix(w.status, "2") {
+				continue
+			}
+
+			if w.date == "" {
+				// not every source provides dates, so undated
+				// results pass the date filters unless asked not to
+				if requireDate {
+					continue
+				}
+			} else if minYear > 0 && !capturedSince(w.date, minYear) {
+				continue
+			}
+
+			// the de-duplication key can be looser than the URL itself,
+			// in which case the first form of it seen is what's output.
+			// -canonicalize has already stripped the URL's trailing
+			// slash, so the key needs it stripped too once
+			// collapseIndex has put it back
+			key := dedupKey(w.url, collapseWWWFlag, collapseSlashFlag || canonicalSlash, indexNameSet)
+
+			// tagged before de-duplication, so that a duplicate that
+			// replaces a buffered result is tagged the same way
+			if known != nil {
+				if u, err := url.Parse(w.url); err == nil {
+					_, w.passiveDNS = known[strings.ToLower(u.Hostname())]
+				}
+			}
+
+			// every source's own URLs, before they're
+			// de-duplicated against the other sources
+			if splitFiles != nil {
+				if err := splitFiles.write(w.source, key, w.url); err != nil {
+					errorf("failed to write -split-by-source files: %s", err)
+				}
+			}
+
+			if dateRange {
+				r, ok := ranges[key]
+				if !ok {
+					r = &captureRange{}
+					ranges[key] = r
+				}
+				r.add(w.date)
+			}
+
+			if asReplay && w.source == "wayback" {
+				r, ok := replays[key]
+				if !ok {
+					r = &captureRange{}
+					replays[key] = r
+				}
+				r.add(w.date)
+			}
+
+			if dedupWindow > 0 {
+				if !windowed.allow(key, w.date) {
+					// the capture counts towards the one output for its window
+					if i, ok := bufferedIdx[key]; ok && withCount {
+						buffered[i].count++
+					}
+					if showDuplicates {
+						logf("", "duplicate from %s: %s", w.source, w.url)
+					}
+					continue
+				}
+			} else {
+				if first, ok := seen.get(key); ok {
+					i, isBuffered := bufferedIdx[key]
+					if isBuffered && withCount {
+						buffered[i].count++
+					}
+					if showDuplicates {
+						logf("", "duplicate from %s (first seen from %s): %s", w.source, first, w.url)
+					}
+
+					// a duplicate from a higher priority source replaces the
+					// buffered result, so the winner doesn't depend on timing
+					if isBuffered && priority.outranks(w.source, first) {
+						summary.reattributeURL(first, w.source)
+						w.count, w.span, w.replay = buffered[i].count, buffered[i].span, buffered[i].replay
+						buffered[i] = w
+						seen.set(key, w.source)
+					}
+					continue
+				}
+				seen.set(key, w.source)
+			}
+
+			if newHostsOnly {
+				u, err := url.Parse(w.url)
+				if err != nil || u.Hostname() == "" {
+					continue
+				}
+				host := strings.ToLower(u.Hostname())
+				if hostsSeen[host] {
+					continue
+				}
+				hostsSeen[host] = true
+			}
+
+			if maxPerHost > 0 {
+				host := ""
+				if u, err := url.Parse(w.url); err == nil {
+					host = strings.ToLower(u.Hostname())
+				}
+				if perHost[host] >= maxPerHost {
+					continue
+				}
+				perHost[host]++
+			}
+
+			summary.addURL(input, w.source)
+			if sizes != nil {
+				sizes.add(w.length)
+			}
+			if hostCounts != nil {
+				host := ""
+				if u, err := url.Parse(w.url); err == nil {
+					host = strings.ToLower(u.Hostname())
+				}
+				hostCounts[host]++
+			}
+
+			if w.passiveDNS {
+				if u, err := url.Parse(w.url); err == nil {
+					known[strings.ToLower(u.Hostname())]++
+				}
+			}
+
+			if recurse {
+				if host := discoverHost(w.url, domain, noSubs); host != "" && !queued[host] {
+					queued[host] = true
+					discovered = append(discovered, host)
+				}
+			}
+
+			for _, name := range matchSecrets(secretRules, w.url) {
+				fmt.Fprintf(secretsOutput, "%s %s\n", name, w.url)
+			}
+
+			if flushMode != "stream" {
+				w.count = 1
+				w.span = ranges[key]
+				w.replay = replays[key]
+				bufferedIdx[key] = len(buffered)
+				buffered = append(buffered, w)
+				continue
+			}
+
+			writeURL(w)
+		}
+
+		if flushMode == "domain" {
+			flush()
+		}
+
+		if dropped > 0 {
+			verbosef("%s: dropped %d unparseable URLs", domain, dropped)
+		}
+
+		if sizes != nil {
+			sizes.write(os.Stderr, input)
+		}
+		if hostCounts != nil {
+			writeHostStats(os.Stderr, input, hostCounts)
+		}
+
+		if known != nil {
+			writeKnownSubdomains(os.Stderr, input, known)
+		}
+
+		if err := sw.Flush(); err != nil {
+			errorf("failed to write output: %s", err)
+		}
+		if splitFiles != nil {
+			splitFiles.nextDomain()
+		}
 
-	var concurrency int
-	flag.IntVar(&concurrency, "concurrency", 5, "number of concurrent requests")
+		if len(discovered) > 0 {
+			verbosef("%s: queueing %d newly discovered hosts", input, len(discovered))
+			for _, host := range discovered {
+				recurseLevel[host] = recurseLevel[input] + 1
+			}
+			domains = append(domains, discovered...)
+		}
+	}
 
-	var timeout int
-	flag.IntVar(&timeout, "timeout", 10, "HTTP request timeout in seconds")
+	if interactive {
+		urls := make([]string, 0, len(buffered))
+		for _, w := range buffered {
+			urls = append(urls, w.url)
+		}
+		if err := runInteractive(urls, os.Stdin, os.Stdout); err != nil {
+			errorf("failed to read input: %s", err)
+		}
+	} else {
+		flush()
+	}
 
-	flag.Parse()
+	if summaryPath != "" {
+		if err := summary.write(summaryPath); err != nil {
+			errorf("failed to write summary: %s", err)
+		}
+	}
 
-	var outputFile *os.File
-	if outputFilePath != "" {
-		var err error
-		outputFile, err = os.Create(outputFilePath)
+	empty := failOnEmpty && summary.TotalUnique == 0
+	if empty {
+		errorf("no URLs found")
+	}
+
+	if sinceLastRun != "" && !failed && ctx.Err() == nil {
+		updated, err := updateState(sinceLastRun, runStart, summary)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to create output file: %s\n", err)
-			os.Exit(1)
+			errorf("failed to update -since-last-run state file: %s", err)
+		} else if !updated {
+			warnf("not updating -since-last-run state file, since fetching from the Wayback Machine failed")
 		}
-		defer outputFile.Close()
-	} else {
-		outputFile = os.Stdout
 	}
 
-	// Initialize the global HTTP client with a timeout
-	httpClient = &http.Client{
-		Timeout: time.Duration(timeout) * time.Second,
+	if failed || ctx.Err() != nil || empty {
+		closeOutput()
+		stopProfiling()
+		os.Exit(1)
 	}
 
-	if flag.NArg() > 0 {
-		// fetch for a single domain
-		domains = []string{flag.Arg(0)}
-	} else {
+}
 
-		// fetch for all domains from stdin
-		sc := bufio.NewScanner(os.Stdin)
-		for sc.Scan() {
-			domains = append(domains, sc.Text())
+type wurl struct {
+	date string
+	url  string
+
+	// status is the HTTP status code at capture time,
+	// for sources that record it
+	status string
+
+	// source is the name of the source that reported the URL
+	source string
+
+	// digest is the SHA1 of the captured content, for
+	// sources that record it
+	digest string
+
+	// length is the size in bytes of the archived response,
+	// for sources that record it
+	length string
+	// live is "live" or "gone" once -annotate-live has checked the URL
+	live string
+
+	// passiveDNS is set by -expand-subdomains on URLs whose host
+	// was already known from passive DNS
+	passiveDNS bool
+
+	// count and span are the number of captures and the range of
+	// capture dates, for -with-count and -date-range
+	count int
+	span  *captureRange
+
+	// replay is the range of Wayback capture dates, for -as-replay
+	replay *captureRange
+}
+
+type fetchFn func(context.Context, string, bool) ([]wurl, error)
+
+// source is a named fetchFn
+type source struct {
+	name  string
+	fetch fetchFn
+}
+
+// cdxFilters are passed to the Wayback CDX server as filter parameters
+var cdxFilters cdxFilterFlag
+
+// cdxOutput is the format requested from the Wayback CDX server: json or text
+var cdxOutput string
+
+// defaultCDXFields is the order archive.org's CDX server returns fields in
+const defaultCDXFields = "urlkey,timestamp,original,mimetype,statuscode,digest,length"
+
+// cdxFields maps the name of each field in a CDX row to its index,
+// so that servers that order them differently can be read
+var cdxFields map[string]int
+
+// parseCDXFields parses a -cdx-fields list, which must name at
+// least the timestamp and original fields
+func parseCDXFields(list string) (map[string]int, error) {
+	out := make(map[string]int)
+	for i, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty field name")
 		}
+		if _, ok := out[name]; ok {
+			return nil, fmt.Errorf("%s is listed more than once", name)
+		}
+		out[name] = i
+	}
 
-		if err := sc.Err(); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to read input: %s\n", err)
+	for _, name := range []string{"timestamp", "original"} {
+		if _, ok := out[name]; !ok {
+			return nil, fmt.Errorf("the %s field is required", name)
 		}
 	}
+	return out, nil
+}
 
-	// get-versions mode
-	if getVersionsFlag {
+// cdxField returns the field called name from a CDX row,
+// or "" if the row or the server doesn't have that field
+func cdxField(row []string, name string) string {
+	i, ok := cdxFields[name]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return row[i]
+}
 
-		for _, u := range domains {
-			versions, err := getVersions(u)
-			if err != nil {
-				continue
-			}
-			fmt.Fprintln(outputFile, strings.Join(versions, "\n"))
+// cdxCollapse is the CDX server's collapse setting, which controls
+// which adjacent captures it treats as duplicates; empty disables it
+var cdxCollapse string
+
+// cdxLimit caps the number of captures the Wayback CDX server returns;
+// zero means no limit and negative values select the last N captures
+var cdxLimit int
+
+// cdxFrom is the earliest capture timestamp, as YYYYMMDDhhmmss, that
+// the Wayback CDX server should return; empty means no limit
+var cdxFrom string
+
+// cdxURLs are the Wayback CDX server endpoints to query, in order;
+// each is only tried once those before it have used up their retries
+var cdxURLs = []string{"http://web.archive.org/cdx/search/cdx"}
+
+// cdxGet sends a request with the given query string to each of
+// cdxURLs in turn, returning the first successful response
+func cdxGet(ctx context.Context, query string) (*http.Response, error) {
+	var err error
+	for i, base := range cdxURLs {
+		var res *http.Response
+		res, err = httpGet(ctx, base+"?"+query)
+		if err == nil {
+			verbosef("wayback: served by %s", base)
+			return res, nil
 		}
 
-		return
+		if ctx.Err() != nil {
+			break
+		}
+		if i+1 < len(cdxURLs) {
+			warnf("wayback: %s failed, trying %s: %s", base, cdxURLs[i+1], err)
+		}
 	}
+	return nil, err
+}
 
-	// Determine which sources to use
-	sources := make(map[string]bool)
-	for _, s := range strings.Split(sourcesFlag, ",") {
-		sources[strings.TrimSpace(s)] = true
+func getWaybackURLs(ctx context.Context, domain string, noSubs bool) ([]wurl, error) {
+	subsWildcard := "*."
+	if noSubs {
+		subsWildcard = ""
 	}
 
-	var fetchFns []fetchFn
-	if sources["wayback"] {
-		fetchFns = append(fetchFns, getWaybackURLs)
+	query := fmt.Sprintf("url=%s%s/*", subsWildcard, domain)
+	if cdxOutput == "json" {
+		query += "&output=json"
 	}
-	if sources["commoncrawl"] {
-		fetchFns = append(fetchFns, getCommonCrawlURLs)
+	if cdxCollapse != "" {
+		query += "&collapse=" + url.QueryEscape(cdxCollapse)
 	}
-	if sources["virustotal"] {
-		fetchFns = append(fetchFns, getVirusTotalURLs)
+	for _, f := range cdxFilters {
+		query += "&filter=" + url.QueryEscape(f)
+	}
+	if cdxLimit != 0 {
+		query += fmt.Sprintf("&limit=%d", cdxLimit)
+	}
+	if cdxFrom != "" {
+		query += "&from=" + cdxFrom
 	}
 
-	if len(fetchFns) == 0 {
-		fmt.Fprintf(os.Stderr, "no valid sources specified. Please choose from: wayback, commoncrawl, virustotal\n")
-		os.Exit(1)
+	res, err := cdxGet(ctx, query)
+	if err != nil {
+		return []wurl{}, err
 	}
 
-	for _, domain := range domains {
+	defer res.Body.Close()
 
-		var wg sync.WaitGroup
-		wurls := make(chan wurl)
-		limiter := make(chan struct{}, concurrency) // Concurrency limiter
+	if err := checkContentType(res, "wayback", domain); err != nil {
+		return []wurl{}, err
+	}
 
-		for _, fn := range fetchFns {
-			wg.Add(1)
-			fetch := fn
-			go func() {
-				defer wg.Done()
-				limiter <- struct{}{} // Acquire a token
-				resp, err := fetch(domain, noSubs)
-				<-limiter // Release the token
-				if err != nil {
-					return
-				}
-				for _, r := range resp {
-					if noSubs && isSubdomain(r.url, domain) {
-						continue
-					}
-					wurls <- r
-				}
-			}()
+	out := make([]wurl, 0)
+
+	decode := decodeCDXRows
+	if cdxOutput == "text" {
+		decode = decodeCDXText
+	}
+
+	err = decode(res.Body, func(row []string) {
+		w := wurl{
+			date:   cdxField(row, "timestamp"),
+			url:    cdxField(row, "original"),
+			status: cdxField(row, "statuscode"),
+			digest: cdxField(row, "digest"),
+			length: cdxField(row, "length"),
 		}
+		if w.date == "" || w.url == "" {
+			return
+		}
+		out = append(out, w)
+	})
 
-		go func() {
-			wg.Wait()
-			close(wurls)
-		}()
+	return out, err
 
-		seen := make(map[string]bool)
-		for w := range wurls {
-			if _, ok := seen[w.url]; ok {
-				continue
-			}
-			seen[w.url] = true
+}
 
-			if dates {
+// decodeCDXRows streams a CDX server JSON response, which is an array of
+// string arrays, calling fn for each row after the header row of field
+// names. Rows are decoded one at a time so memory use doesn't depend on
+// how large the response is. An empty body is treated as having no rows.
+func decodeCDXRows(r io.Reader, fn func(row []string)) error {
+	dec := json.NewDecoder(r)
 
-				d, err := time.Parse("20060102150405", w.date)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "failed to parse date [%s] for URL [%s]\n", w.date, w.url)
-				}
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("unexpected CDX response: expected an array, got %v", tok)
+	}
 
-				fmt.Fprintf(outputFile, "%s %s\n", d.Format(time.RFC3339), w.url)
+	header := true
+	for dec.More() {
+		var row []string
+		if err := dec.Decode(&row); err != nil {
+			return err
+		}
 
-			} else {
-				fmt.Fprintln(outputFile, w.url)
-			}
+		// The first item is always just the field names,
+		// so we should skip the first item
+		if header {
+			header = false
+			continue
 		}
+		fn(row)
 	}
 
+	_, err = dec.Token()
+	return err
 }
 
-type wurl struct {
-	date string
-	url  string
+// decodeCDXText reads a CDX server response in its default text format,
+// which has one space-separated row per line and no header row, calling
+// fn for each row. It's smaller and quicker to parse than the JSON format.
+func decodeCDXText(r io.Reader, fn func(row []string)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		row := strings.Fields(sc.Text())
+		if len(row) == 0 {
+			continue
+		}
+		fn(row)
+	}
+	return sc.Err()
 }
 
-type fetchFn func(string, bool) ([]wurl, error)
+// ccIndex is the Common Crawl crawl that's queried, by either backend
+const ccIndex = "CC-MAIN-2018-22"
 
-func getWaybackURLs(domain string, noSubs bool) ([]wurl, error) {
-	subsWildcard := "*."
-	if noSubs {
-		subsWildcard = ""
+// ccYears, if it's not empty, has the index server backend query every
+// crawl from these years instead of just ccIndex
+var ccYears map[string]bool
+
+// ccYearRe matches a single -cc-years entry
+var ccYearRe = regexp.MustCompile(`^(19|20)[0-9]{2}$`)
+
+// ccCrawls caches the crawls picked by ccYears, which only
+// need looking up once per run
+var ccCrawls struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+// ccIndexes returns the IDs of the crawls to query with the index
+// server: ccIndex, or with -cc-years, every crawl listed in the index
+// server's collinfo.json with an ID from one of those years. A failed
+// lookup isn't cached, so the next domain tries again.
+func ccIndexes(ctx context.Context) ([]string, error) {
+	if len(ccYears) == 0 {
+		return []string{ccIndex}, nil
 	}
 
-	// Use the global httpClient
-	res, err := httpClient.Get(
-		fmt.Sprintf("http://web.archive.org/cdx/search/cdx?url=%s%s/*&output=json&collapse=urlkey", subsWildcard, domain),
-	)
+	ccCrawls.mu.Lock()
+	defer ccCrawls.mu.Unlock()
+	if ccCrawls.ids != nil {
+		return ccCrawls.ids, nil
+	}
+
+	res, err := httpGet(ctx, "http://index.commoncrawl.org/collinfo.json")
 	if err != nil {
-		return []wurl{}, err
+		return nil, err
 	}
+	defer res.Body.Close()
 
-	raw, err := ioutil.ReadAll(res.Body)
+	var crawls []struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&crawls); err != nil {
+		return nil, fmt.Errorf("failed to read the list of Common Crawl crawls: %w", err)
+	}
 
-	res.Body.Close()
-	if err != nil {
-		return []wurl{}, err
+	// IDs look like CC-MAIN-2024-10
+	ids := make([]string, 0)
+	for _, c := range crawls {
+		parts := strings.Split(c.ID, "-")
+		if len(parts) >= 3 && ccYears[parts[2]] {
+			ids = append(ids, c.ID)
+		}
+	}
+	if len(ids) == 0 {
+		warnf("commoncrawl: no crawls found for -cc-years; Common Crawl won't be queried")
+	} else {
+		verbosef("commoncrawl: querying %d crawls: %s", len(ids), strings.Join(ids, ", "))
 	}
 
-	var wrapper [][]string
-	err = json.Unmarshal(raw, &wrapper)
+	ccCrawls.ids = ids
+	return ids, nil
+}
 
-	out := make([]wurl, 0, len(wrapper))
+func getCommonCrawlURLs(ctx context.Context, domain string, noSubs bool) ([]wurl, error) {
+	indexes, err := ccIndexes(ctx)
+	if err != nil {
+		return []wurl{}, err
+	}
 
-	skip := true
-	for _, urls := range wrapper {
-		// The first item is always just the string "original",
-		// so we should skip the first item
-		if skip {
-			skip = false
-			continue
+	out := make([]wurl, 0)
+	for _, index := range indexes {
+		ws, err := getCommonCrawlIndexURLs(ctx, index, domain, noSubs)
+		out = append(out, ws...)
+		if err != nil {
+			return out, err
 		}
-		out = append(out, wurl{date: urls[1], url: urls[2]})
 	}
-
 	return out, nil
-
 }
 
-func getCommonCrawlURLs(domain string, noSubs bool) ([]wurl, error) {
+// getCommonCrawlIndexURLs queries the index server for domain's
+// captures in a single crawl
+func getCommonCrawlIndexURLs(ctx context.Context, index, domain string, noSubs bool) ([]wurl, error) {
 	subsWildcard := "*."
 	if noSubs {
 		subsWildcard = ""
 	}
 
 	// Use the global httpClient
-	res, err := httpClient.Get(
-		fmt.Sprintf("http://index.commoncrawl.org/CC-MAIN-2018-22-index?url=%s%s/*&output=json", subsWildcard, domain),
+	res, err := httpGet(ctx,
+		fmt.Sprintf("http://index.commoncrawl.org/%s-index?url=%s%s/*&output=json", index, subsWildcard, domain),
 	)
 	if err != nil {
+		var se *statusError
+		if errors.As(err, &se) && se.code == http.StatusForbidden {
+			warnf("commoncrawl: blocked (403) for %s; consider a lower -concurrency, a different User-Agent with -header, or -proxy-file", domain)
+		}
 		return []wurl{}, err
 	}
 
 	defer res.Body.Close()
-	sc := bufio.NewScanner(res.Body)
+
+	// when it's blocking a client the index server can also answer
+	// with a captcha page, which would otherwise just look like an
+	// empty result
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		warnf("commoncrawl: blocked (got an HTML page instead of results) for %s; consider a lower -concurrency, a different User-Agent with -header, or -proxy-file", domain)
+		return []wurl{}, fmt.Errorf("commoncrawl returned an HTML page instead of results for %s", domain)
+	}
+	if err := checkContentType(res, "commoncrawl", domain); err != nil {
+		return []wurl{}, err
+	}
+
+	// a bufio.Reader rather than a Scanner, because records with long
+	// URLs can exceed the Scanner's line length limit; the overall size
+	// is still capped by -max-body-size
+	r := bufio.NewReader(res.Body)
 
 	out := make([]wurl, 0)
 
-	for sc.Scan() {
+	for {
+		line, readErr := r.ReadString('\n')
 
-		wrapper := struct {
-			URL       string `json:"url"`
-			Timestamp string `json:"timestamp"`
-		}{}
-		err = json.Unmarshal([]byte(sc.Text()), &wrapper)
+		if strings.TrimSpace(line) != "" {
+			wrapper := struct {
+				URL       string `json:"url"`
+				Timestamp string `json:"timestamp"`
+				Status    string `json:"status"`
+				Length    string `json:"length"`
+			}{}
+			err = json.Unmarshal([]byte(line), &wrapper)
 
-		if err != nil {
-			continue
+			if err == nil {
+				out = append(out, wurl{date: wrapper.Timestamp, url: wrapper.URL, status: wrapper.Status, length: wrapper.Length})
+			}
 		}
 
-		out = append(out, wurl{date: wrapper.Timestamp, url: wrapper.URL})
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			warnf("commoncrawl: failed to read results for %s: %s", domain, readErr)
+			return out, readErr
+		}
 	}
 
 	return out, nil
@@ -255,10 +1979,88 @@ func getCommonCrawlURLs(domain string, noSubs bool) ([]wurl, error) {
 // Declare httpClient globally
 var httpClient *http.Client
 
-func getVirusTotalURLs(domain string, noSubs bool) ([]wurl, error) {
+// newTransport returns the transport that requests are made with: the
+// default one with its dialer swapped out, so that connecting can have
+// a tighter limit than the whole request, and with TLS sessions kept
+// for resuming. With http2 false, only HTTP/1.1 is used.
+func newTransport(connectTimeout time.Duration, http2 bool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+
+	// resuming TLS sessions saves a full handshake for each new
+	// connection to a host we've already talked to
+	transport.TLSClientConfig = &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(64),
+	}
+	transport.ForceAttemptHTTP2 = http2
+	if !http2 {
+		// a non-nil, empty TLSNextProto is how net/http is told
+		// not to negotiate HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// requestHeaders are set on every outbound request
+var requestHeaders = headerFlag{}
+
+// newRequest builds a GET request for u, bound to ctx so
+// that it's abandoned when the run is cancelled
+func newRequest(ctx context.Context, u string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range requestHeaders {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	return req, nil
+}
+
+// httpGet issues a GET request for u using the global httpClient,
+// retrying it according to the retry settings
+func httpGet(ctx context.Context, u string) (*http.Response, error) {
+	req, err := newRequest(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return doRequest(req)
+}
+
+// checkContentType returns an error, after warning about it, unless
+// res has a JSON, NDJSON or plain text Content-Type, so that an HTML
+// captcha or error page isn't handed to a parser expecting results.
+// Plain text is let through because that's what the CDX text format
+// is served as, and a missing Content-Type because it doesn't say
+// anything either way.
+func checkContentType(res *http.Response, source, domain string) error {
+	ct := res.Header.Get("Content-Type")
+	if ct == "" {
+		return nil
+	}
+
+	mt, _, err := mime.ParseMediaType(ct)
+	if err == nil && (mt == "text/plain" || strings.HasSuffix(mt, "json")) {
+		return nil
+	}
+
+	warnf("%s: expected JSON for %s but got %s; ignoring the response", source, domain, ct)
+	return fmt.Errorf("%s returned %s instead of JSON for %s", source, ct, domain)
+}
+
+// inputType is what the inputs are: domain names, or IP addresses
+var inputType string
+
+func getVirusTotalURLs(ctx context.Context, domain string, noSubs bool) ([]wurl, error) {
 	out := make([]wurl, 0)
 
-	apiKey := os.Getenv("VT_API_KEY")
+	apiKey := loadAPIKey("virustotal")
 	if apiKey == "" {
 		// no API key isn't an error,
 		// just don't fetch
@@ -270,26 +2072,58 @@ func getVirusTotalURLs(domain string, noSubs bool) ([]wurl, error) {
 		apiKey,
 		domain,
 	)
+	if inputType == "ip" {
+		// the IP address report has the same detected_urls field
+		fetchURL = fmt.Sprintf(
+			"https://www.virustotal.com/vtapi/v2/ip-address/report?apikey=%s&ip=%s",
+			apiKey,
+			domain,
+		)
+	}
 
 	// Use the global httpClient
-	resp, err := httpClient.Get(fetchURL)
+	resp, err := httpGet(ctx, fetchURL)
 	if err != nil {
+		var se *statusError
+		if errors.As(err, &se) && (se.code == http.StatusUnauthorized || se.code == http.StatusForbidden) {
+			warnf("virustotal: API key rejected (%d); check VIRUSTOTAL_API_KEY or VT_API_KEY", se.code)
+			return out, fmt.Errorf("virustotal returned %d: check VIRUSTOTAL_API_KEY or VT_API_KEY", se.code)
+		}
 		return out, err
 	}
 	defer resp.Body.Close()
 
+	if err := checkContentType(resp, "virustotal", domain); err != nil {
+		return out, err
+	}
+
 	wrapper := struct {
 		URLs []struct {
 			URL string `json:"url"`
 			// TODO: handle VT date format (2018-03-26 09:22:43)
 			//Date string `json:"scan_date"`
 		} `json:"detected_urls"`
+
+		// errors can also come back as a JSON body rather than a status
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
 	}{}
 
 	dec := json.NewDecoder(resp.Body)
 
 	err = dec.Decode(&wrapper)
 
+	switch wrapper.Error.Code {
+	case "":
+	case "WrongCredentialsError", "AuthenticationRequiredError", "ForbiddenError":
+		warnf("virustotal: API key rejected (%s); check VIRUSTOTAL_API_KEY or VT_API_KEY", wrapper.Error.Code)
+		return out, fmt.Errorf("virustotal: %s: %s", wrapper.Error.Code, wrapper.Error.Message)
+	default:
+		return out, fmt.Errorf("virustotal: %s: %s", wrapper.Error.Code, wrapper.Error.Message)
+	}
+
 	for _, u := range wrapper.URLs {
 		out = append(out, wurl{url: u.URL})
 	}
@@ -298,6 +2132,40 @@ func getVirusTotalURLs(domain string, noSubs bool) ([]wurl, error) {
 
 }
 
+// isTerminal reports whether f is an interactive
+// terminal rather than a pipe or a file
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// updateState moves the -since-last-run state file at path on to start,
+// reporting whether it did. The file only limits Wayback results, but if
+// any of those failed it's left alone, since moving it on would lose
+// their captures for good.
+func updateState(path string, start time.Time, summary *runSummary) (bool, error) {
+	if summary.sourceFailed("wayback") {
+		return false, nil
+	}
+	return true, touch(path, start)
+}
+
+// touch sets the modification time of the file at path to t,
+// creating it if it doesn't exist
+func touch(path string, t time.Time) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(path, t, t)
+}
+
 func isSubdomain(rawUrl, domain string) bool {
 	u, err := url.Parse(rawUrl)
 	if err != nil {
@@ -309,19 +2177,120 @@ func isSubdomain(rawUrl, domain string) bool {
 	return strings.ToLower(u.Hostname()) != strings.ToLower(domain)
 }
 
-func getVersions(u string) ([]string, error) {
+// discoverHost returns the hostname of rawURL if it's worth querying
+// as a domain of its own for -recurse-hosts: it has to share domain's
+// parent domain, so that discovery doesn't wander off to other sites,
+// and not already be covered by the query for domain. It returns ""
+// otherwise.
+func discoverHost(rawURL, domain string, noSubs bool) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	host := strings.ToLower(u.Hostname())
+	domain = strings.ToLower(domain)
+	if host == "" || host == domain || parentDomain(host) != parentDomain(domain) {
+		return ""
+	}
+	if !noSubs && strings.HasSuffix(host, "."+domain) {
+		return ""
+	}
+	return host
+}
+
+// versionsResult holds the versions found for urls[index]
+// when fetching versions for many URLs concurrently
+type versionsResult struct {
+	index    int
+	versions []string
+	err      error
+}
+
+// fetchAllVersions calls getVersions for each of urls using up to
+// concurrency workers, each of which also waits on the limiter.
+// Results are sent as they complete, and the channel is closed once
+// every URL has been handled or ctx is done.
+func fetchAllVersions(ctx context.Context, urls []string, filter versionsFilter, concurrency int) <-chan versionsResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobs := make(chan int)
+	results := make(chan versionsResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				limiter.acquire()
+				versions, err := getVersions(ctx, urls[i], filter)
+				limiter.release()
+				results <- versionsResult{index: i, versions: versions, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i := range urls {
+			if ctx.Err() != nil {
+				return
+			}
+			jobs <- i
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+// commaSet splits a comma-separated flag value into a set,
+// ignoring surrounding whitespace and empty entries
+func commaSet(s string) map[string]bool {
+	out := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		out[v] = true
+	}
+	return out
+}
+
+// replayBase is the Wayback replay endpoint that version URLs point at
+var replayBase = "https://web.archive.org/web"
+
+// versionsFilter restricts which versions getVersions returns;
+// empty sets don't filter anything
+type versionsFilter struct {
+	mimes    map[string]bool
+	statuses map[string]bool
+}
+
+// getVersions returns replay URLs for the unique crawled versions of u
+// that have one of the filter's mimetypes and status codes
+func getVersions(ctx context.Context, u string, filter versionsFilter) ([]string, error) {
 	out := make([]string, 0)
 
-	// Use the global httpClient
-	resp, err := httpClient.Get(fmt.Sprintf(
-		"http://web.archive.org/cdx/search/cdx?url=%s&output=json", u,
-	))
+	resp, err := cdxGet(ctx, fmt.Sprintf("url=%s&output=json", u))
 
 	if err != nil {
 		return out, err
 	}
 	defer resp.Body.Close()
 
+	if err := checkContentType(resp, "wayback", u); err != nil {
+		return out, err
+	}
+
 	r := [][]string{}
 
 	dec := json.NewDecoder(resp.Body)
@@ -341,12 +2310,26 @@ func getVersions(u string) ([]string, error) {
 			continue
 		}
 
-		// fields: "urlkey", "timestamp", "original", "mimetype", "statuscode", "digest", "length"
-		if seen[s[5]] {
+		date, orig := cdxField(s, "timestamp"), cdxField(s, "original")
+		if date == "" || orig == "" {
+			continue
+		}
+
+		if len(filter.mimes) > 0 && !filter.mimes[strings.ToLower(cdxField(s, "mimetype"))] {
+			continue
+		}
+		if len(filter.statuses) > 0 && !filter.statuses[cdxField(s, "statuscode")] {
 			continue
 		}
-		seen[s[5]] = true
-		out = append(out, fmt.Sprintf("https://web.archive.org/web/%sif_/%s", s[1], s[2]))
+
+		// without a digest, every capture counts as a new version
+		if digest := cdxField(s, "digest"); digest != "" {
+			if seen[digest] {
+				continue
+			}
+			seen[digest] = true
+		}
+		out = append(out, fmt.Sprintf("%s/%sif_/%s", strings.TrimRight(replayBase, "/"), date, orig))
 	}
 
 	return out, nil
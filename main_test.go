@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rewriteTransport sends every request to a test server,
+// whichever host it was meant for
+type rewriteTransport struct {
+	host string
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// mockSources points httpClient at a test server running h, so that
+// the sources can be tested against canned responses
+func mockSources(t *testing.T, h http.HandlerFunc) {
+	srv := httptest.NewServer(h)
+	prev, prevQuiet := httpClient, quiet
+	httpClient = &http.Client{Transport: rewriteTransport{srv.Listener.Addr().String()}}
+	quiet = true
+	t.Cleanup(func() {
+		httpClient, quiet = prev, prevQuiet
+		srv.Close()
+	})
+}
+
+// syntheticCDX returns a CDX server JSON response with a header row
+// followed by n rows of captures
+func syntheticCDX(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`[["urlkey","timestamp","original","mimetype","statuscode","digest","length"]`)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `,
+["com,example)/page/%d","20200101%06d","http://example.com/page/%d","text/html","200","DIGEST%d","%d"]`, i, i%1000000, i, i, 1000+i)
+	}
+	b.WriteString("]\n")
+	return b.Bytes()
+}
+
+// syntheticCDXText returns the same captures as syntheticCDX, in the
+// CDX server's text format
+func syntheticCDXText(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "com,example)/page/%d 20200101%06d http://example.com/page/%d text/html 200 DIGEST%d %d\n", i, i%1000000, i, i, 1000+i)
+	}
+	return b.Bytes()
+}
+
+func TestDecodeCDXText(t *testing.T) {
+	long := strings.Repeat("a", 2*1024*1024)
+
+	cases := []struct {
+		name    string
+		body    string
+		want    [][]string
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"rows", "k1 20200101000000 http://example.com/a\nk2 20200102000000 http://example.com/b\n",
+			[][]string{{"k1", "20200101000000", "http://example.com/a"}, {"k2", "20200102000000", "http://example.com/b"}}, false},
+		{"no trailing newline", "k1 20200101000000 http://example.com/a",
+			[][]string{{"k1", "20200101000000", "http://example.com/a"}}, false},
+		{"blank lines", "\n  \nk1 20200101000000 http://example.com/a\n\n",
+			[][]string{{"k1", "20200101000000", "http://example.com/a"}}, false},
+		{"short row", "k1 20200101000000\n", [][]string{{"k1", "20200101000000"}}, false},
+		{"extra spaces", "k1   20200101000000\thttp://example.com/a\n",
+			[][]string{{"k1", "20200101000000", "http://example.com/a"}}, false},
+		{"over-long line", "k1 20200101000000 http://example.com/" + long + "\n", nil, true},
+	}
+
+	for _, c := range cases {
+		var have [][]string
+		err := decodeCDXText(strings.NewReader(c.body), func(row []string) {
+			have = append(have, row)
+		})
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: want error %t, have %v", c.name, c.wantErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(have, c.want) {
+			t.Errorf("%s: want rows %q, have %q", c.name, c.want, have)
+		}
+	}
+}
+
+func TestDecodeCDXRowsLarge(t *testing.T) {
+	const n = 200000
+	body := syntheticCDX(n)
+
+	rows := 0
+	err := decodeCDXRows(bytes.NewReader(body), func(row []string) {
+		if len(row) != 7 {
+			t.Fatalf("row %d: want 7 fields, have %d", rows, len(row))
+		}
+		if want := fmt.Sprintf("http://example.com/page/%d", rows); row[2] != want {
+			t.Fatalf("row %d: want %q, have %q", rows, want, row[2])
+		}
+		rows++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != n {
+		t.Errorf("want %d rows, have %d", n, rows)
+	}
+}
+
+func TestDecodeCDXRows(t *testing.T) {
+	cases := []struct {
+		body    string
+		rows    int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"[]", 0, false},
+		{`[["urlkey","timestamp","original"]]`, 0, false},
+		{`[["urlkey","timestamp","original"],["a","1","b"],["c","2","d"]]`, 2, false},
+		{`{"error":"nope"}`, 0, true},
+		{`[["urlkey","timestamp","original"],["a","1"`, 0, true},
+	}
+
+	for _, c := range cases {
+		rows := 0
+		err := decodeCDXRows(strings.NewReader(c.body), func(row []string) {
+			rows++
+		})
+		if (err != nil) != c.wantErr {
+			t.Errorf("decodeCDXRows(%q): want error %t, have %v", c.body, c.wantErr, err)
+			continue
+		}
+		if !c.wantErr && rows != c.rows {
+			t.Errorf("decodeCDXRows(%q): want %d rows, have %d", c.body, c.rows, rows)
+		}
+	}
+}
+
+func TestCommonCrawlBlocked(t *testing.T) {
+	cases := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		wantErr     bool
+		wantURLs    int
+	}{
+		{"403", http.StatusForbidden, "text/plain", "Forbidden", true, 0},
+		{"captcha", http.StatusOK, "text/html; charset=utf-8", "<html>captcha</html>", true, 0},
+		{"results", http.StatusOK, "text/x-ndjson", `{"url":"http://example.com/a","timestamp":"20200101000000"}` + "\n", false, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mockSources(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", c.contentType)
+				w.WriteHeader(c.status)
+				fmt.Fprint(w, c.body)
+			})
+
+			out, err := getCommonCrawlIndexURLs(context.Background(), "CC-MAIN-2024-10", "example.com", false)
+			if (err != nil) != c.wantErr {
+				t.Errorf("want error %t, have %v", c.wantErr, err)
+			}
+			if len(out) != c.wantURLs {
+				t.Errorf("want %d URLs, have %d", c.wantURLs, len(out))
+			}
+		})
+	}
+}
+
+func TestVirusTotalErrors(t *testing.T) {
+	apiKeys["virustotal"] = "bogus"
+	defer delete(apiKeys, "virustotal")
+
+	cases := []struct {
+		name     string
+		status   int
+		body     string
+		wantErr  bool
+		wantURLs int
+	}{
+		{"401", http.StatusUnauthorized, "", true, 0},
+		{"403", http.StatusForbidden, "", true, 0},
+		{"wrong credentials", http.StatusOK, `{"error":{"code":"WrongCredentialsError","message":"Wrong API key"}}`, true, 0},
+		{"other error", http.StatusOK, `{"error":{"code":"QuotaExceededError","message":"Quota exceeded"}}`, true, 0},
+		{"results", http.StatusOK, `{"detected_urls":[{"url":"http://example.com/a"},{"url":"http://example.com/b"}]}`, false, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mockSources(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(c.status)
+				fmt.Fprint(w, c.body)
+			})
+
+			out, err := getVirusTotalURLs(context.Background(), "example.com", false)
+			if (err != nil) != c.wantErr {
+				t.Errorf("want error %t, have %v", c.wantErr, err)
+			}
+			if len(out) != c.wantURLs {
+				t.Errorf("want %d URLs, have %d", c.wantURLs, len(out))
+			}
+			if err != nil && strings.Contains(err.Error(), "bogus") {
+				t.Errorf("error includes the API key: %s", err)
+			}
+		})
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	cases := []struct {
+		contentType string
+		wantErr     bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"application/json; charset=utf-8", false},
+		{"text/x-ndjson", false},
+		{"application/x-ndjson", false},
+		{"text/plain", false},
+		{"text/html", true},
+		{"text/html; charset=utf-8", true},
+		{"application/xml", true},
+	}
+
+	prev := quiet
+	quiet = true
+	defer func() { quiet = prev }()
+
+	for _, c := range cases {
+		res := &http.Response{Header: http.Header{}}
+		if c.contentType != "" {
+			res.Header.Set("Content-Type", c.contentType)
+		}
+		if err := checkContentType(res, "test", "example.com"); (err != nil) != c.wantErr {
+			t.Errorf("checkContentType(%q): want error %t, have %v", c.contentType, c.wantErr, err)
+		}
+	}
+}
+
+func TestSourcesRejectHTML(t *testing.T) {
+	apiKeys["virustotal"] = "bogus"
+	defer delete(apiKeys, "virustotal")
+
+	mockSources(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><a href="http://example.com/a">captcha</a></html>`)
+	})
+
+	fetches := map[string]fetchFn{
+		"wayback":    getWaybackURLs,
+		"virustotal": getVirusTotalURLs,
+		"commoncrawl": func(ctx context.Context, domain string, noSubs bool) ([]wurl, error) {
+			return getCommonCrawlIndexURLs(ctx, "CC-MAIN-2024-10", domain, noSubs)
+		},
+	}
+	for name, fetch := range fetches {
+		out, err := fetch(context.Background(), "example.com", false)
+		if err == nil {
+			t.Errorf("%s: want an error for an HTML response", name)
+		}
+		if len(out) != 0 {
+			t.Errorf("%s: want no URLs, have %d", name, len(out))
+		}
+	}
+
+	if _, err := getVersions(context.Background(), "http://example.com/a", versionsFilter{}); err == nil {
+		t.Error("get-versions: want an error for an HTML response")
+	}
+}
+
+func TestUpdateState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	before := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		source  string
+		updated bool
+	}{
+		{"wayback failed", "wayback", false},
+		{"other source failed", "virustotal", true},
+		{"no failures", "", true},
+	}
+
+	for _, c := range cases {
+		if err := touch(path, before); err != nil {
+			t.Fatal(err)
+		}
+
+		s := newRunSummary()
+		if c.source != "" {
+			s.addError("example.com", c.source, errors.New("failed"))
+		}
+
+		updated, err := updateState(path, start, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated != c.updated {
+			t.Errorf("%s: want updated %t, have %t", c.name, c.updated, updated)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := before
+		if c.updated {
+			want = start
+		}
+		if !info.ModTime().Equal(want) {
+			t.Errorf("%s: want modification time %s, have %s", c.name, want, info.ModTime())
+		}
+	}
+}
+
+func TestTransportReuse(t *testing.T) {
+	for _, http2 := range []bool{true, false} {
+		t.Run(fmt.Sprintf("http2=%t", http2), func(t *testing.T) {
+			var mu sync.Mutex
+			conns, resumed := 0, 0
+			proto := 0
+
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				proto = r.ProtoMajor
+				if r.TLS.DidResume {
+					resumed++
+				}
+			}))
+			srv.EnableHTTP2 = true
+			srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					mu.Lock()
+					conns++
+					mu.Unlock()
+				}
+			}
+			srv.StartTLS()
+			defer srv.Close()
+
+			transport := newTransport(time.Second, http2)
+			transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+			transport.TLSClientConfig.RootCAs.AddCert(srv.Certificate())
+			client := &http.Client{Transport: transport}
+
+			get := func() {
+				res, err := client.Get(srv.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+			}
+
+			// requests one after another share a connection
+			for i := 0; i < 5; i++ {
+				get()
+			}
+			mu.Lock()
+			if conns != 1 {
+				t.Errorf("want 1 connection for 5 requests, have %d", conns)
+			}
+			wantProto := 1
+			if http2 {
+				wantProto = 2
+			}
+			if proto != wantProto {
+				t.Errorf("want HTTP/%d, have HTTP/%d", wantProto, proto)
+			}
+			mu.Unlock()
+
+			// and a new connection resumes the TLS session
+			transport.CloseIdleConnections()
+			get()
+			mu.Lock()
+			defer mu.Unlock()
+			if conns != 2 {
+				t.Errorf("want a second connection, have %d", conns)
+			}
+			if resumed != 1 {
+				t.Errorf("want the second connection to resume the TLS session, have %d resumed requests", resumed)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeCDXRows(b *testing.B) {
+	body := syntheticCDX(10000)
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rows := 0
+		err := decodeCDXRows(bytes.NewReader(body), func(row []string) {
+			rows++
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if rows != 10000 {
+			b.Fatalf("want 10000 rows, have %d", rows)
+		}
+	}
+}
+
+func BenchmarkDecodeCDXText(b *testing.B) {
+	body := syntheticCDXText(10000)
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rows := 0
+		err := decodeCDXText(bytes.NewReader(body), func(row []string) {
+			rows++
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if rows != 10000 {
+			b.Fatalf("want 10000 rows, have %d", rows)
+		}
+	}
+}
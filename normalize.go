@@ -0,0 +1,398 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// trimQuery removes the query string and fragment from rawURL so that
+// URLs differing only in their parameters collapse to a single path.
+// URLs that can't be parsed are returned unchanged.
+func trimQuery(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	return u.String()
+}
+
+// stripFragment removes the fragment from rawURL, since URLs differing
+// only in their fragment are the same resource. URLs that can't be
+// parsed are returned unchanged.
+func stripFragment(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	return u.String()
+}
+
+// canonicalURL puts rawURL into the canonical form used by -canonicalize:
+// the scheme and host are lowercased and a port that's the default for
+// the scheme is removed, then a leading www. and a single trailing slash
+// are removed as with collapseWWW and collapseSlash, if asked for. URLs
+// that can't be parsed are returned unchanged.
+func canonicalURL(rawURL string, www, slash bool) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+
+	out := u.String()
+	if www {
+		out = collapseWWW(out)
+	}
+	if slash {
+		out = collapseSlash(out)
+	}
+	return out
+}
+
+// defaultSessionParams are the query parameters removed by
+// -strip-session-ids, compared case-insensitively
+var defaultSessionParams = []string{
+	"phpsessid", "jsessionid", "aspsessionid", "sid", "sessid",
+	"sessionid", "session_id", "cfid", "cftoken", "oscsid", "zenid",
+}
+
+// stripSessionIDs removes query parameters named in params (which
+// must be lowercase) from rawURL, along with Java-style ;jsessionid=
+// path parameters, so that URLs differing only in a session token
+// collapse together. The remaining parameters keep their order.
+// URLs that can't be parsed are returned unchanged.
+func stripSessionIDs(rawURL string, params map[string]bool) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	// cut from the escaped path, so that escapes such as %2F
+	// earlier in it aren't decoded into something else
+	changed := false
+	escaped := u.EscapedPath()
+	if i := strings.Index(strings.ToLower(escaped), ";jsessionid="); i != -1 {
+		path, err := url.PathUnescape(escaped[:i])
+		if err != nil {
+			return rawURL
+		}
+		u.Path = path
+		u.RawPath = escaped[:i]
+		changed = true
+	}
+
+	if u.RawQuery != "" {
+		kept := make([]string, 0)
+		for _, pair := range strings.Split(u.RawQuery, "&") {
+			name := pair
+			if i := strings.IndexByte(pair, '='); i != -1 {
+				name = pair[:i]
+			}
+			if n, err := url.QueryUnescape(name); err == nil {
+				name = n
+			}
+			if params[strings.ToLower(name)] {
+				changed = true
+				continue
+			}
+			kept = append(kept, pair)
+		}
+		u.RawQuery = strings.Join(kept, "&")
+	}
+
+	if !changed {
+		return rawURL
+	}
+	return u.String()
+}
+
+// defaultTrackingParams are the query parameters removed by
+// -drop-tracking, compared case-insensitively
+var defaultTrackingParams = []string{
+	"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content", "utm_id",
+	"fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid", "yclid",
+	"mc_cid", "mc_eid", "_ga", "_gl", "igshid", "twclid", "ttclid", "mkt_tok",
+}
+
+// dropParams removes query parameters named in params (which must be
+// lowercase) from rawURL, and sorts the rest by name so that URLs with
+// the same parameters in a different order are written the same way.
+// Each parameter keeps its original encoding. URLs that can't be
+// parsed are returned unchanged.
+func dropParams(rawURL string, params map[string]bool) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+
+	type pair struct {
+		name string
+		raw  string
+	}
+
+	kept := make([]pair, 0)
+	for _, raw := range strings.Split(u.RawQuery, "&") {
+		name := raw
+		if i := strings.IndexByte(raw, '='); i != -1 {
+			name = raw[:i]
+		}
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if params[strings.ToLower(name)] {
+			continue
+		}
+		kept = append(kept, pair{name, raw})
+	}
+
+	// stable, so that repeated parameters stay in order
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].name < kept[j].name
+	})
+
+	raws := make([]string, len(kept))
+	for i, p := range kept {
+		raws[i] = p.raw
+	}
+	u.RawQuery = strings.Join(raws, "&")
+	return u.String()
+}
+
+// normalizeEncoding rewrites the percent-encoding in rawURL into the
+// normal form from RFC 3986: escapes of unreserved characters (letters,
+// digits, -, ., _ and ~) are decoded, and all other escapes use
+// uppercase hex. Escapes of reserved characters such as %2F are kept,
+// since decoding them could change what the URL means.
+func normalizeEncoding(rawURL string) string {
+	if !strings.Contains(rawURL, "%") {
+		return rawURL
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(rawURL); i++ {
+		c := rawURL[i]
+		if c != '%' || i+2 >= len(rawURL) || !isHex(rawURL[i+1]) || !isHex(rawURL[i+2]) {
+			b.WriteByte(c)
+			continue
+		}
+
+		v := unhex(rawURL[i+1])<<4 | unhex(rawURL[i+2])
+		if isUnreserved(v) {
+			b.WriteByte(v)
+		} else {
+			b.WriteString(strings.ToUpper(rawURL[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// isUnreserved reports whether c is an unreserved character in RFC 3986
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// collapseWWW removes a leading www. from the host of rawURL, for use
+// as a de-duplication key. URLs that can't be parsed are returned unchanged.
+func collapseWWW(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	if len(u.Host) > 4 && strings.EqualFold(u.Host[:4], "www.") {
+		u.Host = u.Host[4:]
+	}
+
+	return u.String()
+}
+
+// collapseSlash removes a single trailing slash from the path of rawURL,
+// other than the root path, for use as a de-duplication key. URLs with a
+// query string are left alone, as are URLs that can't be parsed.
+func collapseSlash(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	if u.RawQuery != "" || u.ForceQuery {
+		return rawURL
+	}
+
+	// checked on the escaped path, since an escaped %2F at
+	// the end is part of a segment rather than a slash
+	escaped := u.EscapedPath()
+	if len(escaped) <= 1 || !strings.HasSuffix(escaped, "/") {
+		return rawURL
+	}
+
+	escaped = strings.TrimSuffix(escaped, "/")
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return rawURL
+	}
+	u.Path = path
+	u.RawPath = escaped
+
+	return u.String()
+}
+
+// defaultIndexNames are the directory index filenames removed by
+// -collapse-index
+var defaultIndexNames = []string{
+	"index.html", "index.htm", "index.php", "index.asp", "index.aspx", "index.jsp",
+}
+
+// collapseIndex removes a last path segment of rawURL that's one of
+// names (which must be lowercase), leaving the trailing slash, so that
+// /dir/index.html and /dir/ compare equal. URLs with a query string
+// are left alone, since the index page may well act on it, as are URLs
+// that can't be parsed.
+func collapseIndex(rawURL string, names map[string]bool) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	if u.RawQuery != "" || u.ForceQuery {
+		return rawURL
+	}
+
+	// cut from the escaped path, since an escaped %2F in the last
+	// segment is part of it rather than a slash
+	escaped := u.EscapedPath()
+	i := strings.LastIndex(escaped, "/")
+	if i == -1 {
+		return rawURL
+	}
+	last, err := url.PathUnescape(escaped[i+1:])
+	if err != nil || !names[strings.ToLower(last)] {
+		return rawURL
+	}
+
+	escaped = escaped[:i+1]
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return rawURL
+	}
+	u.Path = path
+	u.RawPath = escaped
+
+	return u.String()
+}
+
+// dedupKey is the key rawURL is de-duplicated by, which can be looser
+// than the URL itself: with www, a leading www. is ignored, with slash,
+// a trailing slash on the path is, and with indexNames set, so is a
+// last path segment that's one of them.
+func dedupKey(rawURL string, www, slash bool, indexNames map[string]bool) string {
+	key := rawURL
+	if www {
+		key = collapseWWW(key)
+	}
+	if indexNames != nil {
+		key = collapseIndex(key, indexNames)
+	}
+	if slash {
+		key = collapseSlash(key)
+	}
+	return key
+}
+
+// fuzzNumeric replaces every purely numeric segment in the path of rawURL
+// with placeholder, so that templated URLs like /user/123/posts and
+// /user/456/posts collapse together. The query string is left alone,
+// as are URLs that can't be parsed.
+func fuzzNumeric(rawURL, placeholder string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	segs := strings.Split(u.EscapedPath(), "/")
+	changed := false
+	for i, seg := range segs {
+		if isDigits(seg) {
+			segs[i] = placeholder
+			changed = true
+		}
+	}
+	if !changed {
+		return rawURL
+	}
+
+	escaped := strings.Join(segs, "/")
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return rawURL
+	}
+	u.Path = path
+	u.RawPath = escaped
+
+	return u.String()
+}
+
+// isDigits reports whether s is non-empty and made up only of ASCII digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// schemeRe matches a URL that starts with a scheme, as opposed to one
+// that merely contains "://" somewhere in its path or query
+var schemeRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*://`)
+
+// addScheme prefixes rawURL with scheme if it doesn't already have one,
+// so that e.g. example.com/path is parsed as a host and path rather
+// than just a path. Protocol-relative URLs (//example.com/path) get
+// just the scheme.
+func addScheme(rawURL, scheme string) string {
+	if schemeRe.MatchString(rawURL) {
+		return rawURL
+	}
+	if strings.HasPrefix(rawURL, "//") {
+		return scheme + ":" + rawURL
+	}
+	return scheme + "://" + rawURL
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCollapseSlash(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"http://example.com/dir/", "http://example.com/dir"},
+		{"http://example.com/dir", "http://example.com/dir"},
+		{"http://example.com/", "http://example.com/"},
+		{"http://example.com/dir/?x=1", "http://example.com/dir/?x=1"},
+		{"http://example.com/a%20b/", "http://example.com/a%20b"},
+
+		// an escaped slash is part of the last segment
+		{"http://example.com/p~user/%2F", "http://example.com/p~user/%2F"},
+		{"http://example.com/a%2Fb/", "http://example.com/a%2Fb"},
+	}
+
+	for _, c := range cases {
+		if have := collapseSlash(c.in); have != c.want {
+			t.Errorf("collapseSlash(%q): want %q, have %q", c.in, c.want, have)
+		}
+	}
+}
+
+func TestCanonicalURL(t *testing.T) {
+	cases := []struct {
+		in    string
+		www   bool
+		slash bool
+		want  string
+	}{
+		{"HTTP://Example.COM:80/Path/", false, false, "http://example.com/Path/"},
+		{"https://example.com:443/x", false, false, "https://example.com/x"},
+		{"https://example.com:8443/x", false, false, "https://example.com:8443/x"},
+		{"http://WWW.example.com/dir/", true, true, "http://example.com/dir"},
+		{"http://www.example.com/dir/?q=1", true, true, "http://example.com/dir/?q=1"},
+
+		// escaped slashes mean something different to real ones
+		{"http://example.com/p~user/%2F", true, true, "http://example.com/p~user/%2F"},
+	}
+
+	for _, c := range cases {
+		if have := canonicalURL(c.in, c.www, c.slash); have != c.want {
+			t.Errorf("canonicalURL(%q, %t, %t): want %q, have %q", c.in, c.www, c.slash, c.want, have)
+		}
+	}
+}
+
+func TestAddScheme(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"example.com/path", "http://example.com/path"},
+		{"//example.com/path", "http://example.com/path"},
+		{"http://example.com/", "http://example.com/"},
+		{"HTTPS://example.com/", "HTTPS://example.com/"},
+		{"svn+ssh://example.com/repo", "svn+ssh://example.com/repo"},
+
+		// a URL in the query string isn't a scheme
+		{"example.com/redirect?to=http://evil.com/", "http://example.com/redirect?to=http://evil.com/"},
+		{"example.com/a://b", "http://example.com/a://b"},
+	}
+
+	for _, c := range cases {
+		if have := addScheme(c.in, "http"); have != c.want {
+			t.Errorf("addScheme(%q): want %q, have %q", c.in, c.want, have)
+		}
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	names := commaSet(strings.Join(defaultIndexNames, ","))
+
+	// with -canonicalize, URLs reach dedupKey with their trailing
+	// slash already stripped
+	a := dedupKey(canonicalURL("http://example.com/a/", false, true), false, true, names)
+	b := dedupKey(canonicalURL("http://example.com/a/index.html", false, true), false, true, names)
+	if a != b {
+		t.Errorf("want /a/ and /a/index.html to share a key, have %q and %q", a, b)
+	}
+
+	cases := []struct {
+		in    string
+		www   bool
+		slash bool
+		want  string
+	}{
+		{"http://www.example.com/a", true, false, "http://example.com/a"},
+		{"http://www.example.com/a", false, false, "http://www.example.com/a"},
+		{"http://example.com/a/", false, true, "http://example.com/a"},
+		{"http://example.com/a/index.html", false, false, "http://example.com/a/"},
+		{"http://example.com/a/index.html", false, true, "http://example.com/a"},
+		{"http://example.com/index.php?x=1", false, true, "http://example.com/index.php?x=1"},
+	}
+
+	for _, c := range cases {
+		if have := dedupKey(c.in, c.www, c.slash, names); have != c.want {
+			t.Errorf("dedupKey(%q, %t, %t): want %q, have %q", c.in, c.www, c.slash, c.want, have)
+		}
+	}
+}
+
+func TestCollapseIndex(t *testing.T) {
+	names := commaSet(strings.Join(defaultIndexNames, ","))
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"http://example.com/a/index.html", "http://example.com/a/"},
+		{"http://example.com/a/INDEX.HTML", "http://example.com/a/"},
+		{"http://example.com/a/", "http://example.com/a/"},
+		{"http://example.com/index.php", "http://example.com/"},
+		{"http://example.com/a/page.html", "http://example.com/a/page.html"},
+		{"http://example.com/a/myindex.html", "http://example.com/a/myindex.html"},
+
+		// an escaped slash is part of a segment
+		{"http://example.com/a%2Fb/index.html", "http://example.com/a%2Fb/"},
+		{"http://example.com/a%2Findex.html", "http://example.com/a%2Findex.html"},
+		{"http://example.com/a/%69ndex.html", "http://example.com/a/"},
+
+		// the index page may act on the query string
+		{"http://example.com/index.php?x=1", "http://example.com/index.php?x=1"},
+		{"http://example.com/index.php?", "http://example.com/index.php?"},
+	}
+
+	for _, c := range cases {
+		if have := collapseIndex(c.in, names); have != c.want {
+			t.Errorf("collapseIndex(%q): want %q, have %q", c.in, c.want, have)
+		}
+	}
+}
+
+func TestCollapseWWW(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"http://www.example.com/x", "http://example.com/x"},
+		{"http://WWW.example.com/x", "http://example.com/x"},
+		{"http://example.com/x", "http://example.com/x"},
+		{"https://www.example.com:8443/x?y=1", "https://example.com:8443/x?y=1"},
+		{"http://www2.example.com/x", "http://www2.example.com/x"},
+		{"http://sub.www.example.com/x", "http://sub.www.example.com/x"},
+		{"http://example.com/www.x", "http://example.com/www.x"},
+		{"http://www./x", "http://www./x"},
+	}
+
+	for _, c := range cases {
+		if have := collapseWWW(c.in); have != c.want {
+			t.Errorf("collapseWWW(%q): want %q, have %q", c.in, c.want, have)
+		}
+	}
+}
+
+func TestFuzzNumeric(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"http://example.com/user/123/posts", "http://example.com/user/FUZZ/posts"},
+		{"http://example.com/user/123/posts/456", "http://example.com/user/FUZZ/posts/FUZZ"},
+		{"http://example.com/2020/01/02/", "http://example.com/FUZZ/FUZZ/FUZZ/"},
+		{"http://example.com/v2/items", "http://example.com/v2/items"},
+		{"http://example.com/123.html", "http://example.com/123.html"},
+
+		// the query string is left alone
+		{"http://example.com/user/123?id=456", "http://example.com/user/FUZZ?id=456"},
+		{"http://example.com/search?page=2", "http://example.com/search?page=2"},
+
+		// escaping elsewhere in the path is kept
+		{"http://example.com/a%2Fb/123", "http://example.com/a%2Fb/FUZZ"},
+	}
+
+	for _, c := range cases {
+		if have := fuzzNumeric(c.in, "FUZZ"); have != c.want {
+			t.Errorf("fuzzNumeric(%q): want %q, have %q", c.in, c.want, have)
+		}
+	}
+}
+
+func TestNormalizeEncoding(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"http://example.com/path", "http://example.com/path"},
+		{"http://example.com/a%2fb", "http://example.com/a%2Fb"},
+		{"http://example.com/a%2Fb", "http://example.com/a%2Fb"},
+		{"http://example.com/%7euser", "http://example.com/~user"},
+		{"http://example.com/%41%62%2d%5F", "http://example.com/Ab-_"},
+		{"http://example.com/a%2fb%3a%3A%7E?q=%e2%82%ac", "http://example.com/a%2Fb%3A%3A~?q=%E2%82%AC"},
+
+		// broken escapes are left as they are
+		{"http://example.com/100%", "http://example.com/100%"},
+		{"http://example.com/%zz%2", "http://example.com/%zz%2"},
+	}
+
+	for _, c := range cases {
+		if have := normalizeEncoding(c.in); have != c.want {
+			t.Errorf("normalizeEncoding(%q): want %q, have %q", c.in, c.want, have)
+		}
+	}
+}
+
+func TestDropParams(t *testing.T) {
+	tracking := commaSet(strings.Join(defaultTrackingParams, ","))
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"http://example.com/a", "http://example.com/a"},
+		{"http://example.com/a?utm_source=x", "http://example.com/a"},
+		{"http://example.com/a?id=1&utm_source=x&fbclid=y", "http://example.com/a?id=1"},
+		{"http://example.com/a?UTM_Source=x&id=1", "http://example.com/a?id=1"},
+		{"http://example.com/a?utm%5Fsource=x&id=1", "http://example.com/a?id=1"},
+
+		// what's left is sorted by name, repeats staying in order
+		{"http://example.com/a?b=2&a=1&gclid=z", "http://example.com/a?a=1&b=2"},
+		{"http://example.com/a?x=2&x=1&a", "http://example.com/a?a&x=2&x=1"},
+
+		// encoding is kept as it was
+		{"http://example.com/a?q=a%20b&utm_medium=c", "http://example.com/a?q=a%20b"},
+		{"http://example.com/a?utm_source=x#top", "http://example.com/a#top"},
+	}
+
+	for _, c := range cases {
+		if have := dropParams(c.in, tracking); have != c.want {
+			t.Errorf("dropParams(%q): want %q, have %q", c.in, c.want, have)
+		}
+	}
+}
+
+func TestStripSessionIDs(t *testing.T) {
+	params := commaSet(strings.Join(defaultSessionParams, ","))
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"http://example.com/a", "http://example.com/a"},
+		{"http://example.com/a;jsessionid=123", "http://example.com/a"},
+		{"http://example.com/a;JSESSIONID=123?x=1", "http://example.com/a?x=1"},
+		{"http://example.com/a?PHPSESSID=abc&x=1", "http://example.com/a?x=1"},
+		{"http://example.com/a?Sid=abc", "http://example.com/a"},
+
+		// names are compared once they've been unescaped
+		{"http://example.com/a?PHPSESS%49D=abc&x=1", "http://example.com/a?x=1"},
+
+		// the other parameters keep their order and encoding
+		{"http://example.com/a?z=1&sid=2&a=3&q=a%20b", "http://example.com/a?z=1&a=3&q=a%20b"},
+		{"http://example.com/a?sessionid_x=1", "http://example.com/a?sessionid_x=1"},
+
+		// an escaped slash stays escaped
+		{"http://example.com/a%2Fb;jsessionid=123", "http://example.com/a%2Fb"},
+		{"http://example.com/a%2Fb/c?sid=1", "http://example.com/a%2Fb/c"},
+	}
+
+	for _, c := range cases {
+		if have := stripSessionIDs(c.in, params); have != c.want {
+			t.Errorf("stripSessionIDs(%q): want %q, have %q", c.in, c.want, have)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostGroup is a set of results that share a hostname
+type hostGroup struct {
+	host string
+	urls []wurl
+}
+
+// groupByHost sorts ws by hostname and then by path, and splits them
+// into one group per hostname. URLs that can't be parsed are grouped
+// together under an empty hostname, which sorts first.
+func groupByHost(ws []wurl) []hostGroup {
+	type keyed struct {
+		host string
+		path string
+		w    wurl
+	}
+
+	ks := make([]keyed, 0, len(ws))
+	for _, w := range ws {
+		k := keyed{w: w}
+		if u, err := url.Parse(w.url); err == nil {
+			k.host = strings.ToLower(u.Hostname())
+			k.path = u.Path
+		}
+		ks = append(ks, k)
+	}
+
+	sort.SliceStable(ks, func(i, j int) bool {
+		if ks[i].host != ks[j].host {
+			return ks[i].host < ks[j].host
+		}
+		if ks[i].path != ks[j].path {
+			return ks[i].path < ks[j].path
+		}
+		return ks[i].w.url < ks[j].w.url
+	})
+
+	var out []hostGroup
+	for _, k := range ks {
+		if len(out) == 0 || out[len(out)-1].host != k.host {
+			out = append(out, hostGroup{host: k.host})
+		}
+		last := &out[len(out)-1]
+		last.urls = append(last.urls, k.w)
+	}
+	return out
+}
+
+// version is the tool's version, set at build time with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+// lineFormat is how results are written as lines of text output
+type lineFormat struct {
+	prefix string
+	suffix string
+	end    string
+
+	digest         bool
+	live           bool
+	dates          bool
+	rawTimestamp   bool
+	bothTimestamps bool
+}
+
+// format returns the line of text output for w, with u (its URL, or
+// the replay link for it) in place of the URL
+func (f lineFormat) format(w wurl, u string) string {
+	line := f.prefix + u + f.suffix
+	if f.digest {
+		// a placeholder keeps the columns lined up for sources
+		// that don't record digests
+		digest := w.digest
+		if digest == "" {
+			digest = "-"
+		}
+		line = digest + " " + line
+	}
+	if f.live {
+		line = "[" + w.live + "] " + line
+	}
+
+	if f.dates && (f.rawTimestamp || f.bothTimestamps) {
+		// not every source has dates, so there's
+		// nothing to warn about for those without one
+		raw, formatted := "-", "-"
+		if w.date != "" {
+			raw = w.date
+			if d, err := time.Parse("20060102150405", w.date); err == nil {
+				formatted = d.Format(time.RFC3339)
+			}
+		}
+
+		if f.bothTimestamps {
+			return formatted + " " + raw + " " + line + f.end
+		}
+		return raw + " " + line + f.end
+	}
+
+	if f.dates {
+		d, err := time.Parse("20060102150405", w.date)
+		if err != nil {
+			warnf("failed to parse date [%s] for URL [%s]", w.date, w.url)
+		}
+		return d.Format(time.RFC3339) + " " + line + f.end
+	}
+
+	return line + f.end
+}
+
+// jsonSchemaVersion identifies the format of -json records, and is
+// bumped whenever that format changes in an incompatible way
+const jsonSchemaVersion = 1
+
+// jsonRecord is a line of -json output
+type jsonRecord struct {
+	URL        string `json:"url"`
+	Timestamp  string `json:"timestamp,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Count      int    `json:"count,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Replay     string `json:"replay,omitempty"`
+	Live       string `json:"live,omitempty"`
+	FirstSeen  string `json:"first_seen,omitempty"`
+	LastSeen   string `json:"last_seen,omitempty"`
+	PassiveDNS bool   `json:"passive_dns,omitempty"`
+}
+
+// errorRecord is a line of -json output that reports a failed fetch,
+// written with -errors-in-stream
+type errorRecord struct {
+	Error   bool   `json:"error"`
+	Domain  string `json:"domain"`
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
+// writeJSONMeta writes the -json-meta line that describes the
+// format of the records that follow it
+func writeJSONMeta(w io.Writer) error {
+	meta := struct {
+		Meta struct {
+			Schema  int    `json:"schema"`
+			Tool    string `json:"tool"`
+			Version string `json:"version"`
+		} `json:"_meta"`
+	}{}
+	meta.Meta.Schema = jsonSchemaVersion
+	meta.Meta.Tool = "waybackurls"
+	meta.Meta.Version = version
+
+	return json.NewEncoder(w).Encode(meta)
+}
+
+// syncWriter serializes writes to w, so that output written from more
+// than one goroutine can't interleave. Every line of output is written
+// with a single Write call, which keeps lines whole.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// flushers are the buffers between w and the output, in the order
+	// they're flushed in by Flush
+	flushers []flusher
+}
+
+// flusher is a buffered writer, such as a bufio.Writer or gzip.Writer
+type flusher interface {
+	Flush() error
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// Flush writes out anything buffered, holding the lock so that it
+// doesn't race with writes from other goroutines
+func (s *syncWriter) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.flushers {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openAppend opens path for appending, creating it if need be. If the
+// file isn't empty and doesn't already end with end, end is written
+// first so that the first new entry doesn't run on from the last old one.
+func openAppend(path string, end byte) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return f, nil
+	}
+
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if last[0] != end {
+		if _, err := f.Write([]byte{end}); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// sourceFiles writes each source's URLs to a file of its own,
+// <dir>/<source>.txt, for -split-by-source. Each source's URLs are
+// de-duplicated separately, so that a URL found by more than one
+// source is in each of their files.
+type sourceFiles struct {
+	dir   string
+	files map[string]*sourceFile
+}
+
+type sourceFile struct {
+	f    *os.File
+	w    *bufio.Writer
+	seen map[string]bool
+}
+
+func newSourceFiles(dir string) (*sourceFiles, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &sourceFiles{dir: dir, files: make(map[string]*sourceFile)}, nil
+}
+
+// write adds u to source's file, unless a URL with the same
+// de-duplication key is already there for the current domain
+func (s *sourceFiles) write(source, key, u string) error {
+	sf, ok := s.files[source]
+	if !ok {
+		f, err := os.Create(filepath.Join(s.dir, source+".txt"))
+		if err != nil {
+			return err
+		}
+		sf = &sourceFile{f: f, w: bufio.NewWriter(f), seen: make(map[string]bool)}
+		s.files[source] = sf
+	}
+
+	if sf.seen[key] {
+		return nil
+	}
+	sf.seen[key] = true
+	_, err := sf.w.WriteString(u + "\n")
+	return err
+}
+
+// nextDomain forgets the URLs seen so far, since de-duplication
+// is per domain
+func (s *sourceFiles) nextDomain() {
+	for _, sf := range s.files {
+		sf.seen = make(map[string]bool)
+	}
+}
+
+// close flushes and closes every file, returning the first error
+func (s *sourceFiles) close() error {
+	var first error
+	for _, sf := range s.files {
+		if err := sf.w.Flush(); err != nil && first == nil {
+			first = err
+		}
+		if err := sf.f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	s.files = make(map[string]*sourceFile)
+	return first
+}
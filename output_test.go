@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSyncWriterConcurrent(t *testing.T) {
+	const writers, lines = 50, 1000
+
+	var out bytes.Buffer
+	buf := bufio.NewWriterSize(&out, 512)
+	sw := &syncWriter{w: buf, flushers: []flusher{buf}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				fmt.Fprintf(sw, "http://example.com/%d/%d\n", i, j)
+				if j%100 == 0 {
+					if err := sw.Flush(); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := sw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, l := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		var i, j int
+		if _, err := fmt.Sscanf(l, "http://example.com/%d/%d", &i, &j); err != nil {
+			t.Fatalf("interleaved line %q", l)
+		}
+		seen[l] = true
+	}
+	if len(seen) != writers*lines {
+		t.Errorf("want %d distinct lines, have %d", writers*lines, len(seen))
+	}
+}
+
+func TestLineFormat(t *testing.T) {
+	wayback := wurl{date: "20200101000000", url: "http://example.com/a", digest: "ABC123", source: "wayback"}
+	vt := wurl{url: "http://example.com/b", source: "virustotal"}
+
+	cases := []struct {
+		f    lineFormat
+		w    wurl
+		want string
+	}{
+		{lineFormat{end: "\n"}, wayback, "http://example.com/a\n"},
+		{lineFormat{end: "\n", digest: true}, wayback, "ABC123 http://example.com/a\n"},
+		{lineFormat{end: "\n", digest: true}, vt, "- http://example.com/b\n"},
+		{lineFormat{end: "\n", dates: true, rawTimestamp: true, digest: true}, vt, "- - http://example.com/b\n"},
+		{lineFormat{end: "\n", dates: true}, wayback, "2020-01-01T00:00:00Z http://example.com/a\n"},
+		{lineFormat{end: "\x00", prefix: "<", suffix: ">"}, wayback, "<http://example.com/a>\x00"},
+	}
+
+	for _, c := range cases {
+		if have := c.f.format(c.w, c.w.url); have != c.want {
+			t.Errorf("format(%+v) with %+v: want %q, have %q", c.w, c.f, c.want, have)
+		}
+	}
+}
+
+func BenchmarkLineFormat(b *testing.B) {
+	w := wurl{date: "20200101000000", url: "http://example.com/a/b?c=d", source: "wayback"}
+
+	b.Run("plain", func(b *testing.B) {
+		f := lineFormat{end: "\n"}
+		for i := 0; i < b.N; i++ {
+			f.format(w, w.url)
+		}
+	})
+
+	b.Run("dates", func(b *testing.B) {
+		f := lineFormat{end: "\n", dates: true}
+		for i := 0; i < b.N; i++ {
+			f.format(w, w.url)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling starts writing a CPU profile to cpuPath, if it's set.
+// The returned function stops it, and writes a heap profile to memPath
+// if that's set; it must be called before exiting for the profiles to
+// be complete.
+func startProfiling(cpuPath, memPath string) (func(), error) {
+	var cpuFile *os.File
+	if cpuPath != "" {
+		f, err := os.Create(cpuPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		cpuFile = f
+	}
+
+	stopped := false
+	return func() {
+		if stopped {
+			return
+		}
+		stopped = true
+
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+		}
+
+		if memPath == "" {
+			return
+		}
+
+		f, err := os.Create(memPath)
+		if err != nil {
+			errorf("failed to create memory profile: %s", err)
+			return
+		}
+		defer f.Close()
+
+		// get up-to-date statistics
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			errorf("failed to write memory profile: %s", err)
+		}
+	}, nil
+}
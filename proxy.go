@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// proxyPool is a RoundTripper that sends each request through one of
+// a list of proxies, moving on to the next one if a proxy can't be used
+type proxyPool struct {
+	proxies    []*url.URL
+	transports []*http.Transport
+	random     bool
+
+	mu   sync.Mutex
+	next int
+}
+
+// newProxyPool returns a proxyPool for proxies, each with its own copy
+// of base so that their connections are kept apart
+func newProxyPool(base *http.Transport, proxies []*url.URL, strategy string) (*proxyPool, error) {
+	if strategy != "round-robin" && strategy != "random" {
+		return nil, fmt.Errorf("invalid -proxy-strategy [%s]. Please choose from: round-robin, random", strategy)
+	}
+
+	p := &proxyPool{proxies: proxies, random: strategy == "random"}
+	for _, u := range proxies {
+		t := base.Clone()
+		t.Proxy = http.ProxyURL(u)
+		p.transports = append(p.transports, t)
+	}
+	return p, nil
+}
+
+// pick returns the index of the proxy to try first
+func (p *proxyPool) pick() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.random {
+		return rand.Intn(len(p.proxies))
+	}
+	i := p.next
+	p.next = (p.next + 1) % len(p.proxies)
+	return i
+}
+
+func (p *proxyPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := p.pick()
+
+	var err error
+	for n := 0; n < len(p.proxies); n++ {
+		i := (start + n) % len(p.proxies)
+
+		var res *http.Response
+		res, err = p.transports[i].RoundTrip(req)
+		if err == nil {
+			return res, nil
+		}
+
+		// a cancelled or timed out request would fail the
+		// same way through any proxy
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		warnf("proxy %s failed, trying the next one: %s", p.proxies[i].Redacted(), err)
+	}
+	return nil, err
+}
+
+// loadProxies reads a list of proxy URLs, one per line, from path.
+// Blank lines and lines starting with # are ignored.
+func loadProxies(path string) ([]*url.URL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*url.URL
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		u, err := url.Parse(line)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL [%s]; expected e.g. http://host:port or socks5://host:port", line)
+		}
+		out = append(out, u)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no proxies found in %s", path)
+	}
+	return out, nil
+}
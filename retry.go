@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// retries is how many times a failed request is retried before giving up
+var retries = 2
+
+// sourceRetries overrides retries for the named sources
+var sourceRetries = make(map[string]int)
+
+// origin records the source and domain that requests are made for
+type origin struct {
+	source string
+	domain string
+}
+
+type originKey struct{}
+
+// withOrigin returns a copy of ctx recording that its requests are
+// being made by the named source for domain
+func withOrigin(ctx context.Context, source, domain string) context.Context {
+	return context.WithValue(ctx, originKey{}, origin{source: source, domain: domain})
+}
+
+// originFrom returns the origin recorded in ctx, if there is one
+func originFrom(ctx context.Context) (origin, bool) {
+	o, ok := ctx.Value(originKey{}).(origin)
+	return o, ok
+}
+
+// retriesFor returns the retry budget for requests made with ctx,
+// which depends on the source they're being made for
+func retriesFor(ctx context.Context) int {
+	o, _ := originFrom(ctx)
+	if n, ok := sourceRetries[o.source]; ok {
+		return n
+	}
+	return retries
+}
+
+// retryBackoff is the delay before the first retry; it doubles after each one
+var retryBackoff = time.Second
+
+// statusError is returned for responses with a 4xx or 5xx status code
+type statusError struct {
+	url  string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned %d %s", e.url, e.code, http.StatusText(e.code))
+}
+
+// retryable reports whether a request that failed with err might
+// succeed if it's tried again. Network errors, timeouts, rate limiting
+// and server errors are worth retrying; other client errors (bad
+// requests, rejected credentials) won't fix themselves.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code == http.StatusTooManyRequests || se.code >= 500
+	}
+	return true
+}
+
+// doRequest sends req using the global httpClient, retrying it if it fails
+// in a way that's worth retrying. Responses with an error status code are
+// turned into a *statusError so that sources don't try to parse them.
+func doRequest(req *http.Request) (*http.Response, error) {
+	brk := breakerFrom(req.Context())
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		if brk != nil {
+			if err := brk.check(); err != nil {
+				return nil, err
+			}
+		}
+
+		res, err := httpClient.Do(req)
+		if err == nil && res.StatusCode >= 400 {
+			res.Body.Close()
+			err = &statusError{url: redactURL(req.URL), code: res.StatusCode}
+		}
+		if brk != nil {
+			brk.record(err)
+		}
+		if limiter != nil {
+			limiter.record(err)
+		}
+		if err == nil {
+			if req.Method == http.MethodGet && res.StatusCode == http.StatusOK {
+				res.Body = &resumableBody{req: req, rc: res.Body, total: res.ContentLength, validator: rangeValidator(res), ranges: resumable(req, res)}
+			}
+			if maxBodySize > 0 {
+				res.Body = &limitedBody{rc: res.Body, remaining: maxBodySize, url: redactURL(req.URL)}
+			}
+			if rawDumpDir != "" {
+				if o, ok := originFrom(req.Context()); ok {
+					res.Body = dumpBody(res, o)
+				}
+			}
+			return res, nil
+		}
+
+		// url.Error includes the full URL, which can contain API keys
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			ue.URL = redactURL(req.URL)
+		}
+
+		// give up if the run has been cancelled too
+		ctx := req.Context()
+		if attempt >= retriesFor(ctx) || !retryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		verbosef("retrying %s in %s: %s", redactURL(req.URL), backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// redactURL returns u as a string with the values of any
+// credential parameters replaced, for use in diagnostics
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	changed := false
+	for _, k := range []string{"apikey", "api_key", "key"} {
+		if q.Has(k) {
+			q.Set(k, "REDACTED")
+			changed = true
+		}
+	}
+	if !changed {
+		return u.String()
+	}
+
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// maxBodySize is the most that will be read from any response
+// body, in bytes, so that a misbehaving endpoint can't exhaust
+// memory. Zero means no limit.
+var maxBodySize int64
+
+// limitedBody is a response body that fails, rather than just
+// stopping, once more than a set number of bytes have been read
+type limitedBody struct {
+	rc        io.ReadCloser
+	remaining int64
+	url       string
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// only an error if there's actually more to read
+		var one [1]byte
+		n, err := b.rc.Read(one[:])
+		if n == 0 {
+			return 0, err
+		}
+
+		if !b.exceeded {
+			b.exceeded = true
+			warnf("response from %s exceeds -max-body-size, ignoring the rest of it", b.url)
+		}
+		return 0, fmt.Errorf("response from %s exceeds -max-body-size", b.url)
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.rc.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.rc.Close()
+}
+
+// resumable reports whether the body of res, the response to req,
+// can be picked up part way through with a Range request if the
+// connection drops. Bodies the transport has decompressed can't be,
+// since the server's byte offsets are for the compressed form.
+func resumable(req *http.Request, res *http.Response) bool {
+	return req.Method == http.MethodGet &&
+		res.StatusCode == http.StatusOK &&
+		res.Header.Get("Accept-Ranges") == "bytes" &&
+		!res.Uncompressed
+}
+
+// rangeValidator returns the value to send in If-Range when resuming
+// res, so that the server sends the whole thing again rather than
+// the rest of a response that's since changed; it's empty if res has
+// no strong ETag or Last-Modified date
+func rangeValidator(res *http.Response) string {
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return res.Header.Get("Last-Modified")
+}
+
+// resumableBody is a response body that, if the connection drops part
+// way through, asks for the rest with a Range request and carries on
+// from where it got to rather than failing. If the server won't send
+// just the rest, the read fails with a *restartError, so that the whole
+// request is made again.
+type resumableBody struct {
+	req       *http.Request
+	rc        io.ReadCloser
+	read      int64
+	total     int64
+	validator string
+	resumes   int
+
+	// ranges is set if the server said it accepts Range requests
+	ranges bool
+}
+
+// errNoRange is returned by resume when the server won't send
+// just the rest of the response
+var errNoRange = errors.New("server won't send just the rest of the response")
+
+// restartError is a read error from a response body that couldn't be
+// resumed. What was read of the body before it has to be thrown away,
+// and the request made again from the start.
+type restartError struct {
+	err error
+}
+
+func (e *restartError) Error() string {
+	return e.err.Error()
+}
+
+func (e *restartError) Unwrap() error {
+	return e.err
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.read += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	if !b.ranges {
+		return n, &restartError{err}
+	}
+
+	if rerr := b.resume(err); rerr != nil {
+		verbosef("couldn't resume %s: %s", redactURL(b.req.URL), rerr)
+		if errors.Is(rerr, errNoRange) {
+			return n, &restartError{err}
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+// resume replaces the body with the rest of the response from the
+// current offset, after the read error err, using the same retry
+// budget and backoff as failed requests
+func (b *resumableBody) resume(err error) error {
+	ctx := b.req.Context()
+	if b.resumes >= retriesFor(ctx) {
+		return fmt.Errorf("out of retries")
+	}
+
+	backoff := retryBackoff << b.resumes
+	b.resumes++
+	verbosef("resuming %s from byte %d in %s: %s", redactURL(b.req.URL), b.read, backoff, err)
+	select {
+	case <-time.After(backoff):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	req := b.req.Clone(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.read))
+	if b.validator != "" {
+		req.Header.Set("If-Range", b.validator)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return fmt.Errorf("%w: it answered the range request with %d", errNoRange, res.StatusCode)
+	}
+
+	// the rest has to start where we got to, and be of the same response
+	var start, end, total int64
+	if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil ||
+		start != b.read || (b.total >= 0 && total != b.total) {
+		res.Body.Close()
+		return fmt.Errorf("%w: unexpected Content-Range [%s]", errNoRange, res.Header.Get("Content-Range"))
+	}
+
+	b.rc.Close()
+	b.rc = res.Body
+	return nil
+}
+
+func (b *resumableBody) Close() error {
+	return b.rc.Close()
+}
+
+// retryEmpty enables retrying sources whose empty results are ambiguous
+var retryEmpty bool
+
+// emptyIsAmbiguous lists the sources that can return a valid but empty
+// result under heavy load, where a retry may well turn up captures
+var emptyIsAmbiguous = map[string]bool{
+	"wayback":     true,
+	"commoncrawl": true,
+}
+
+// fetchSource queries src for domain. A source whose response was cut
+// off and couldn't be resumed is queried again from the start, throwing
+// away what it returned. With retryEmpty set, sources whose empty
+// results are ambiguous are queried again too, until they return
+// something. Both use the same budget and backoff as failed requests.
+func fetchSource(ctx context.Context, src source, domain string, noSubs bool) ([]wurl, error) {
+	ctx = withOrigin(ctx, src.name, domain)
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := src.fetch(ctx, domain, noSubs)
+
+		var re *restartError
+		switch {
+		case errors.As(err, &re):
+			if attempt >= retriesFor(ctx) {
+				return resp, err
+			}
+			verbosef("%s: response for %s was cut off and can't be resumed, fetching it again in %s", src.name, domain, backoff)
+		case err != nil || len(resp) > 0 || !retryEmpty || !emptyIsAmbiguous[src.name]:
+			return resp, err
+		case attempt >= retriesFor(ctx):
+			return resp, nil
+		default:
+			verbosef("%s: no results for %s, retrying in %s", src.name, domain, backoff)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return resp, err
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&statusError{code: http.StatusBadRequest}, false},
+		{&statusError{code: http.StatusUnauthorized}, false},
+		{&statusError{code: http.StatusForbidden}, false},
+		{&statusError{code: http.StatusNotFound}, false},
+		{&statusError{code: http.StatusTooManyRequests}, true},
+		{&statusError{code: http.StatusInternalServerError}, true},
+		{&statusError{code: http.StatusBadGateway}, true},
+		{&statusError{code: http.StatusServiceUnavailable}, true},
+		{context.DeadlineExceeded, true},
+		{errors.New("connection reset by peer"), true},
+	}
+
+	for _, c := range cases {
+		if have := retryable(c.err); have != c.want {
+			t.Errorf("retryable(%v): want %t, have %t", c.err, c.want, have)
+		}
+	}
+}
+
+func TestDoRequest(t *testing.T) {
+	// the server answers each request for /<code> with that status code;
+	// /flaky fails once and then succeeds
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		n := attempts[r.URL.Path]
+		mu.Unlock()
+
+		if r.URL.Path == "/flaky" {
+			if n == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		code, _ := strconv.Atoi(r.URL.Path[1:])
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	httpClient = srv.Client()
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	cases := []struct {
+		path     string
+		wantCode int
+		attempts int
+	}{
+		{"/200", 0, 1},
+		{"/400", http.StatusBadRequest, 1},
+		{"/401", http.StatusUnauthorized, 1},
+		{"/403", http.StatusForbidden, 1},
+		{"/404", http.StatusNotFound, 1},
+		{"/429", http.StatusTooManyRequests, retries + 1},
+		{"/500", http.StatusInternalServerError, retries + 1},
+		{"/503", http.StatusServiceUnavailable, retries + 1},
+		{"/flaky", 0, 2},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", srv.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := doRequest(req)
+		if c.wantCode == 0 {
+			if err != nil {
+				t.Errorf("%s: want success, have %s", c.path, err)
+			} else {
+				res.Body.Close()
+			}
+		} else {
+			var se *statusError
+			if !errors.As(err, &se) || se.code != c.wantCode {
+				t.Errorf("%s: want status %d, have %v", c.path, c.wantCode, err)
+			}
+		}
+
+		mu.Lock()
+		n := attempts[c.path]
+		mu.Unlock()
+		if n != c.attempts {
+			t.Errorf("%s: want %d attempts, have %d", c.path, c.attempts, n)
+		}
+	}
+}
+
+// cutOffServer serves body, with the Accept-Ranges and ETag headers
+// given, but cuts the connection half way through the first response.
+// rangeReply answers any Range request that follows.
+func cutOffServer(t *testing.T, body, acceptRanges string, rangeReply http.HandlerFunc) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Range") != "" {
+			rangeReply(w, r)
+			return
+		}
+
+		if acceptRanges != "" {
+			w.Header().Set("Accept-Ranges", acceptRanges)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if n > 1 {
+			// later attempts get the whole thing
+			fmt.Fprint(w, body)
+			return
+		}
+
+		fmt.Fprint(w, body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestResumableBody(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+	half := len(body) / 2
+
+	// rest answers with the rest of body from the offset asked for
+	rest := func(w http.ResponseWriter, r *http.Request) {
+		var from int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &from)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, len(body)-1, len(body)))
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, body[from:])
+	}
+
+	cases := []struct {
+		name         string
+		acceptRanges string
+		rangeReply   http.HandlerFunc
+		wantRestart  bool
+	}{
+		{"resumed", "bytes", rest, false},
+		{"mismatched Content-Range", "bytes", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(body)-1, len(body)))
+			w.WriteHeader(http.StatusPartialContent)
+			fmt.Fprint(w, body)
+		}, true},
+		{"If-Range mismatch", "bytes", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-Range") != `"v1"` {
+				t.Errorf("want If-Range \"v1\", have %q", r.Header.Get("If-Range"))
+			}
+			// the response has changed, so it's sent in full
+			fmt.Fprint(w, body)
+		}, true},
+		{"no Accept-Ranges", "", func(w http.ResponseWriter, r *http.Request) {
+			t.Error("want no Range request to a server without Accept-Ranges")
+		}, true},
+	}
+
+	httpClient = http.DefaultClient
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, _ := cutOffServer(t, body, c.acceptRanges, c.rangeReply)
+
+			req, err := http.NewRequest("GET", srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := doRequest(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			got, err := io.ReadAll(res.Body)
+			var re *restartError
+			if errors.As(err, &re) != c.wantRestart {
+				t.Fatalf("want restart %t, have %v", c.wantRestart, err)
+			}
+			if c.wantRestart {
+				if len(got) < half-1 || len(got) > half {
+					t.Errorf("want the first half of the body before the error, have %d bytes", len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != body {
+				t.Errorf("want the whole body (%d bytes), have %d bytes", len(body), len(got))
+			}
+		})
+	}
+}
+
+func TestFetchSourceRestarts(t *testing.T) {
+	body := strings.Repeat("http://example.com/page\n", 500)
+	srv, requests := cutOffServer(t, body, "", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("want no Range request to a server without Accept-Ranges")
+	})
+
+	httpClient = http.DefaultClient
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	src := source{"test", func(ctx context.Context, domain string, noSubs bool) ([]wurl, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := doRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+
+		out := make([]wurl, 0)
+		r := bufio.NewReader(res.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err == io.EOF {
+				return out, nil
+			}
+			if err != nil {
+				return out, err
+			}
+			out = append(out, wurl{url: strings.TrimSpace(line)})
+		}
+	}}
+
+	out, err := fetchSource(context.Background(), src, "example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 500 {
+		t.Errorf("want only the 500 URLs from the full response, have %d", len(out))
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("want 2 requests, have %d", n)
+	}
+}
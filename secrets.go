@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// secretRule is a named pattern for spotting credentials in URLs
+type secretRule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// defaultSecretRules is the built-in ruleset used by -scan-secrets
+var defaultSecretRules = []secretRule{
+	{"aws-access-key", regexp.MustCompile(`\b(AKIA|ASIA|AGPA|AIDA|AROA|AIPA|ANPA|ANVA)[A-Z0-9]{16}\b`)},
+	{"google-api-key", regexp.MustCompile(`AIza[0-9A-Za-z_-]{35}`)},
+	{"github-token", regexp.MustCompile(`gh[pousr]_[0-9A-Za-z]{36}`)},
+	{"slack-token", regexp.MustCompile(`xox[abprs]-[0-9A-Za-z-]{10,}`)},
+	{"stripe-secret-key", regexp.MustCompile(`sk_live_[0-9A-Za-z]{24,}`)},
+	{"jwt", regexp.MustCompile(`eyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+	{"api-key-param", regexp.MustCompile(`(?i)[?&](api[_-]?key|apikey)=[^&#]{8,}`)},
+	{"token-param", regexp.MustCompile(`(?i)[?&](access_token|auth_token|token)=[^&#]{8,}`)},
+	{"secret-param", regexp.MustCompile(`(?i)[?&](client_secret|secret|password|passwd|pwd)=[^&#]+`)},
+}
+
+// loadSecretRules reads extra rules from path, one per line in the
+// form "<name> <regex>". Blank lines and lines starting with # are ignored.
+func loadSecretRules(path string) ([]secretRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []secretRule
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected <name> <regex>", path, n)
+		}
+
+		re, err := regexp.Compile(strings.TrimSpace(strings.TrimPrefix(line, parts[0])))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+
+		out = append(out, secretRule{name: parts[0], re: re})
+	}
+
+	return out, sc.Err()
+}
+
+// matchSecrets returns the names of the rules that match u
+func matchSecrets(rules []secretRule, u string) []string {
+	var out []string
+	for _, r := range rules {
+		if r.re.MatchString(u) {
+			out = append(out, r.name)
+		}
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// crtshURL is the certificate transparency search used to look up
+// subdomains for -expand-subdomains
+var crtshURL = "https://crt.sh/"
+
+// lookupSubdomains returns the subdomains of domain that have appeared
+// in certificates logged to certificate transparency, according to
+// crt.sh. Wildcard names are reduced to the domain they cover.
+func lookupSubdomains(ctx context.Context, domain string) ([]string, error) {
+	ctx = withOrigin(ctx, "crtsh", domain)
+
+	q := url.Values{}
+	q.Set("q", "%."+domain)
+	q.Set("output", "json")
+	res, err := httpGet(ctx, crtshURL+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if err := checkContentType(res, "crtsh", domain); err != nil {
+		return nil, err
+	}
+
+	var certs []struct {
+		NameValue string `json:"name_value"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&certs); err != nil {
+		return nil, fmt.Errorf("crtsh: failed to read results for %s: %w", domain, err)
+	}
+
+	domain = strings.ToLower(domain)
+	found := make(map[string]bool)
+	for _, c := range certs {
+		// one certificate can name several hosts, one per line
+		for _, name := range strings.Split(c.NameValue, "\n") {
+			name = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "*.")
+			if strings.HasSuffix(name, "."+domain) {
+				found[name] = true
+			}
+		}
+	}
+
+	out := make([]string, 0, len(found))
+	for name := range found {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// writeKnownSubdomains prints how many of domain's subdomains from
+// passive DNS had URLs found for them to w, listing those that
+// didn't when -verbose is set
+func writeKnownSubdomains(w io.Writer, domain string, known map[string]int) {
+	var missing []string
+	for sub, n := range known {
+		if n == 0 {
+			missing = append(missing, sub)
+		}
+	}
+	sort.Strings(missing)
+
+	fmt.Fprintf(w, "%s: %d subdomains known from passive DNS, %d with archived URLs\n", domain, len(known), len(known)-len(missing))
+	if verbose {
+		for _, sub := range missing {
+			fmt.Fprintf(w, "  no archived URLs: %s\n", sub)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// runSummary accumulates the counts and errors for a run so
+// that they can be written out as JSON once it's finished
+type runSummary struct {
+	Domains     map[string]int `json:"domains"`
+	Sources     map[string]int `json:"sources"`
+	TotalUnique int            `json:"total_unique"`
+	Errors      []fetchError   `json:"errors"`
+	Duration    float64        `json:"duration_seconds"`
+
+	mu    sync.Mutex
+	start time.Time
+}
+
+// fetchError records a source failing for a domain
+type fetchError struct {
+	Domain string `json:"domain"`
+	Source string `json:"source"`
+	Error  string `json:"error"`
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{
+		Domains: make(map[string]int),
+		Sources: make(map[string]int),
+		Errors:  make([]fetchError, 0),
+		start:   time.Now(),
+	}
+}
+
+// addDomain makes sure domain is listed even if it has no results
+func (s *runSummary) addDomain(domain string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Domains[domain] += 0
+}
+
+// addURL counts a unique URL that was output for domain,
+// attributing it to the source that reported it
+func (s *runSummary) addURL(domain, source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Domains[domain]++
+	s.Sources[source]++
+	s.TotalUnique++
+}
+
+// reattributeURL moves a unique URL's count from one source to
+// another, when a duplicate from a higher priority source replaces it
+func (s *runSummary) reattributeURL(from, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Sources[from]--
+	s.Sources[to]++
+}
+
+func (s *runSummary) addError(domain, source string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Errors = append(s.Errors, fetchError{
+		Domain: domain,
+		Source: source,
+		Error:  err.Error(),
+	})
+}
+
+// sourceFailed reports whether source failed for any domain
+func (s *runSummary) sourceFailed(source string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.Errors {
+		if e.Source == source {
+			return true
+		}
+	}
+	return false
+}
+
+// write saves the summary as JSON to path
+func (s *runSummary) write(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Duration = time.Since(s.start).Seconds()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceHeaders are request headers whose values are never traced
+var traceHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Apikey":            true,
+}
+
+// tracingTransport is a RoundTripper that logs every request it
+// sends, and the response to it, to stderr for -trace
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := redactURL(req.URL)
+	logf("", "> %s %s", req.Method, u)
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(req.Header[name], ", ")
+		if traceHeaders[http.CanonicalHeaderKey(name)] {
+			value = "REDACTED"
+		}
+		logf("", ">   %s: %s", name, value)
+	}
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		logf("", "< %s %s failed after %s: %s", req.Method, u, time.Since(start).Round(time.Millisecond), err)
+		return nil, err
+	}
+
+	// the size and time taken are only known once the body has
+	// been read, so they're logged when it's closed
+	res.Body = &tracedBody{rc: res.Body, method: req.Method, url: u, status: res.Status, start: start}
+	return res, nil
+}
+
+// tracedBody counts the bytes read from a response body,
+// and logs the totals when it's closed
+type tracedBody struct {
+	rc     io.ReadCloser
+	method string
+	url    string
+	status string
+	start  time.Time
+
+	n    int64
+	once sync.Once
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	err := b.rc.Close()
+	b.once.Do(func() {
+		logf("", "< %s %s %s: %d bytes in %s", b.status, b.method, b.url, b.n, time.Since(b.start).Round(time.Millisecond))
+	})
+	return err
+}